@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuthConfig configures authentication of operation requests. Without any method configured
+// the operations are open.
+type AuthConfig struct {
+	// Keys are static API keys, sent as "X-API-Key: <key>" or "Authorization: Bearer <key>".
+	Keys []APIKey `json:"keys,omitempty"`
+	// HMACSecret verifies HS256/HS384/HS512 signed bearer tokens (JWTs).
+	HMACSecret Secret `json:"hmacSecret,omitempty"`
+	// JWKS is a local JSON Web Key Set file verifying RS*, PS* and ES* signed bearer tokens.
+	JWKS string `json:"jwks,omitempty"`
+	// Issuer and Audience are required iss and aud claims of tokens, if set.
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+}
+
+// Enabled reports whether any authentication method is configured.
+func (c AuthConfig) Enabled() bool {
+	return len(c.Keys) > 0 || c.HMACSecret != "" || c.JWKS != ""
+}
+
+// APIKey is a static API key identifying a principal.
+type APIKey struct {
+	Name string `json:"name"`
+	Key  Secret `json:"key"`
+	// RateLimit replaces throttle.perClient for requests with this key.
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+}
+
+// Secret is a configuration value hidden when the configuration is printed.
+type Secret string
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal("REDACTED")
+}
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Name identifies the caller: the API key name or the token subject.
+	Name string
+	// Method is the authentication method, e.g. "api-key", "hmac" or "jwt".
+	Method string
+	// RateLimit is the limit of the principal's API key, nil to apply throttle.perClient.
+	RateLimit *RateLimit
+}
+
+// Authenticator verifies the credentials of a request. It returns errNoCredentials if the request
+// carries none it is responsible for, so the next authenticator is tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+var errNoCredentials = errors.New("no credentials")
+
+// NewAuthenticators returns the authenticators of all configured methods.
+func NewAuthenticators(config AuthConfig) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	if len(config.Keys) > 0 {
+		keys := apiKeys{}
+		for _, k := range config.Keys {
+			keys[sha256.Sum256([]byte(k.Key))] = Principal{Name: k.Name, Method: "api-key", RateLimit: k.RateLimit}
+		}
+		authenticators = append(authenticators, keys)
+	}
+	if config.HMACSecret != "" {
+		authenticators = append(authenticators, &hmacTokens{secret: []byte(config.HMACSecret), config: config, now: time.Now})
+	}
+	if config.JWKS != "" {
+		keys, err := loadJWKS(config.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, &jwksTokens{keys: keys, config: config, now: time.Now})
+	}
+	return authenticators, nil
+}
+
+// Authenticate requires requests to authenticate with one of the authenticators, answering 401
+// otherwise. The principal is recorded in the request logs and limited by Throttler.Principals.
+// Without authenticators all requests pass.
+func Authenticate(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(authenticators) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authenticate(authenticators, r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				if errors.Is(err, errNoCredentials) {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+				}
+				writeOperationOutcome(w, http.StatusUnauthorized, "login", err.Error())
+				return
+			}
+			info := requestInfoFrom(r.Context())
+			info.principal = principal.Method + ":" + principal.Name
+			info.principalRateLimit = principal.RateLimit
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func authenticate(authenticators []Authenticator, r *http.Request) (Principal, error) {
+	for _, a := range authenticators {
+		principal, err := a.Authenticate(r)
+		if !errors.Is(err, errNoCredentials) {
+			return principal, err
+		}
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" {
+		return Principal{}, errors.New("invalid credentials")
+	}
+	return Principal{}, fmt.Errorf("authentication required: %w", errNoCredentials)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// apiKeys maps the SHA-256 of each key to its principal, so lookups don't leak key prefixes through timing.
+type apiKeys map[[sha256.Size]byte]Principal
+
+func (keys apiKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if principal, ok := keys[sha256.Sum256([]byte(key))]; ok && key != "" {
+		return principal, nil
+	}
+	return Principal{}, errNoCredentials
+}
+
+// hmacTokens verifies bearer JWTs signed with a shared secret.
+type hmacTokens struct {
+	secret []byte
+	config AuthConfig
+	now    func() time.Time
+}
+
+func (a *hmacTokens) Authenticate(r *http.Request) (Principal, error) {
+	token := bearerToken(r)
+	if !looksLikeJWT(token) {
+		return Principal{}, errNoCredentials
+	}
+	t, err := parseJWT(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !strings.HasPrefix(t.header.Alg, "HS") {
+		return Principal{}, errNoCredentials
+	}
+	if err := t.verifyHMAC(a.secret); err != nil {
+		return Principal{}, err
+	}
+	if err := t.validate(a.now(), a.config.Issuer, a.config.Audience); err != nil {
+		return Principal{}, err
+	}
+	return Principal{Name: t.claims.Subject, Method: "hmac"}, nil
+}
+
+// jwksTokens verifies bearer JWTs signed with one of the keys of a JWKS.
+type jwksTokens struct {
+	keys   []jwksKey
+	config AuthConfig
+	now    func() time.Time
+}
+
+func (a *jwksTokens) Authenticate(r *http.Request) (Principal, error) {
+	token := bearerToken(r)
+	if !looksLikeJWT(token) {
+		return Principal{}, errNoCredentials
+	}
+	t, err := parseJWT(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	if strings.HasPrefix(t.header.Alg, "HS") {
+		return Principal{}, errNoCredentials
+	}
+
+	err = errors.New("no matching key")
+	for _, k := range a.keys {
+		if (t.header.Kid != "" && k.kid != t.header.Kid) || (k.alg != "" && k.alg != t.header.Alg) {
+			continue
+		}
+		if err = t.verifyKey(k.key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if err := t.validate(a.now(), a.config.Issuer, a.config.Audience); err != nil {
+		return Principal{}, err
+	}
+	return Principal{Name: t.claims.Subject, Method: "jwt"}, nil
+}
+
+func (c AuthConfig) validate() []error {
+	var errs []error
+	seen := map[Secret]bool{}
+	for i, k := range c.Keys {
+		if k.Name == "" || k.Key == "" {
+			errs = append(errs, fmt.Errorf("auth.keys[%d] needs a name and a key", i))
+		}
+		if seen[k.Key] {
+			errs = append(errs, fmt.Errorf("auth.keys[%d] duplicates the key of another entry", i))
+		}
+		seen[k.Key] = true
+		if k.RateLimit != nil {
+			errs = append(errs, k.RateLimit.validate(fmt.Sprintf("auth.keys[%d].rateLimit", i))...)
+		}
+	}
+	if c.JWKS != "" {
+		if _, err := loadJWKS(c.JWKS); err != nil {
+			errs = append(errs, fmt.Errorf("auth.jwks: %w", err))
+		}
+	}
+	return errs
+}
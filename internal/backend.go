@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
 	"github.com/damedic/fhir-toolbox-go/model"
@@ -11,6 +12,7 @@ import (
 	"github.com/damedic/fhir-toolbox-go/model/gen/r4b"
 	"github.com/damedic/fhir-toolbox-go/model/gen/r5"
 	"github.com/damedic/fhir-toolbox-go/utils/ptr"
+	"go.opentelemetry.io/otel/attribute"
 	"strings"
 	"time"
 )
@@ -19,6 +21,13 @@ import (
 
 type Backend struct {
 	BaseURL string
+	// Store optionally provides resources for resolve() beyond those submitted with the request.
+	Store *ResourceStore
+	// ParseCache optionally caches parsed expressions across requests.
+	ParseCache *ParseCache
+	// EchoResource is how the resource is echoed unless requested otherwise: EchoResourceFull
+	// (the default), EchoResourceHash or EchoResourceOmit.
+	EchoResource string
 }
 
 type fpTracer struct {
@@ -45,10 +54,10 @@ func (b *Backend) CapabilityBase(ctx context.Context) (r4.CapabilityStatement, e
 		Kind:        r4.Code{Value: ptr.To("instance")},
 		Date:        r4.DateTime{Value: ptr.To(now)},
 		FhirVersion: r4.Code{Value: ptr.To("4.0")},
-		Format:      []r4.Code{{Value: ptr.To("json")}},
+		Format:      []r4.Code{{Value: ptr.To("json")}, {Value: ptr.To("xml")}},
 		Software: &r4.CapabilityStatementSoftware{
 			Name:    r4.String{Value: ptr.To("fhirpath-lab-go-cmd")},
-			Version: &r4.String{Value: ptr.To("0.1.0")},
+			Version: &r4.String{Value: ptr.To(ReadBuildInfo().SoftwareVersion())},
 		},
 		Implementation: &r4.CapabilityStatementImplementation{
 			Description: r4.String{Value: ptr.To("FHIRPath Lab operations cmd (Go)")},
@@ -73,6 +82,14 @@ func (b *Backend) FHIRPathR5OperationDefinition() r4.OperationDefinition {
 	return operationDefinition("fhirpath-r5")
 }
 
+func (b *Backend) FHIRPathAutoOperationDefinition() r4.OperationDefinition {
+	return operationDefinition("fhirpath-auto")
+}
+
+func (b *Backend) FHIRPathCompareOperationDefinition() r4.OperationDefinition {
+	return operationDefinition("fhirpath-compare")
+}
+
 func operationDefinition(codeAndID string) r4.OperationDefinition {
 	// Build the OperationDefinition including input/output parameters per the fhirpath-lab cmd engine API specification.
 	in := func(name string, min int32, max string, typ *string, doc string) r4.OperationDefinitionParameter {
@@ -125,6 +142,24 @@ func operationDefinition(codeAndID string) r4.OperationDefinition {
 		out("value[x]", 0, "1", nil, "Variable value using appropriate value[x] (any FHIR type or Resource)."),
 	}
 
+	// warnings (output) – non-fatal issues found during evaluation, e.g. unresolvable references
+	warningsOut := out("warnings", 0, "1", nil, "Non-fatal issues encountered during evaluation.")
+	warningsOut.Part = []r4.OperationDefinitionParameter{
+		out("warning", 1, "*", tString, "Warning message, e.g. a reference that could not be resolved."),
+	}
+
+	// timing (output) – microseconds spent in each phase, if requested
+	tDecimal := ptr.To("decimal")
+	timingOut := out("timing", 0, "1", nil, "Microseconds spent in each phase of the evaluation, if requested by the timing input.")
+	timingOut.Part = []r4.OperationDefinitionParameter{
+		out("decodeResource", 1, "1", tDecimal, "Decoding the request and the resource, including the json-value or xml-value extension."),
+		out("parseExpression", 1, "1", tDecimal, "Parsing the expression."),
+		out("parseContext", 0, "1", tDecimal, "Parsing the context expression, if any."),
+		out("evaluateContext", 0, "1", tDecimal, "Evaluating the context expression, if any."),
+		out("evaluate", 0, "*", tDecimal, "Evaluating the expression, one per context item in the order of the result parameters."),
+		out("serialize", 1, "1", tDecimal, "Building the response Parameters, up to this timing part."),
+	}
+
 	// parameters (output) – describes request echo and additional metadata
 	parametersOut := out("parameters", 1, "1", nil, "Input parameters and evaluation metadata.")
 	parametersOut.Part = []r4.OperationDefinitionParameter{
@@ -132,10 +167,16 @@ func operationDefinition(codeAndID string) r4.OperationDefinition {
 		out("parseDebugTree", 0, "1", tString, "Parser debug AST (JSON as string)."),
 		out("expression", 1, "1", tString, "The expression that was executed."),
 		out("context", 0, "1", tString, "The context expression used, if any."),
-		out("resource", 1, "1", tResource, "The resource used as evaluation input."),
+		out("resource", 0, "1", tResource, "The resource used as evaluation input; only its hash (resource-hash extension) or nothing if requested by echoResource."),
 		variablesOut,
 		out("expectedReturnType", 0, "1", tString, "Optional static analysis expected return type."),
 		out("parseDebug", 0, "1", tString, "Optional unformatted parser debug messages."),
+		warningsOut,
+		timingOut,
+	}
+	if codeAndID == "fhirpath-auto" {
+		parametersOut.Part = append(parametersOut.Part,
+			out("detectedRelease", 1, "1", tString, "FHIR release the resource was decoded and evaluated in (R4, R4B or R5)."))
 	}
 
 	// result (output) – one per context item; includes results and traces
@@ -160,6 +201,18 @@ func operationDefinition(codeAndID string) r4.OperationDefinition {
 		"Optional step-by-step execution trace per context. The parameter valueString identifies the context. Each part is named '{position},{length},{function}' and contains sub-parts such as resource-path, focus-resource-path, this-resource-path, index, and evaluated values.",
 	)
 
+	outputs := []r4.OperationDefinitionParameter{parametersOut, resultOut, debugTraceOut}
+	if codeAndID == "fhirpath-compare" {
+		// release (output) – one per release, containing that release's result parameters
+		releaseOut := out("release", 3, "3", nil, "Evaluation per FHIR release; valueString is the release (R4, R4B or R5). Parts are the release's 'result' parameters, 'warnings' and an 'error' if the evaluation failed.")
+		// diff (output) – differences between every pair of releases
+		diffOut := out("diff", 0, "1", nil, "Differences between the results of every pair of releases (R4-R4B, R4-R5 and R4B-R5).")
+		diffOut.Part = []r4.OperationDefinitionParameter{
+			out("difference", 0, "*", tString, "One difference of a release relative to a base release; valueString is the kind (error, context, count, type, value or representation). Parts: base, release, context, index and the value representations named by release."),
+		}
+		outputs = []r4.OperationDefinitionParameter{parametersOut, releaseOut, diffOut}
+	}
+
 	return r4.OperationDefinition{
 		Id:       &r4.Id{Value: ptr.To(codeAndID)},
 		Name:     r4.String{Value: ptr.To("FHIRPath Evaluate")},
@@ -169,69 +222,161 @@ func operationDefinition(codeAndID string) r4.OperationDefinition {
 		System:   r4.Boolean{Value: ptr.To(true)},
 		Type:     r4.Boolean{Value: ptr.To(false)},
 		Instance: r4.Boolean{Value: ptr.To(false)},
-		Parameter: []r4.OperationDefinitionParameter{
+		Parameter: append([]r4.OperationDefinitionParameter{
 			// Inputs
 			in("expression", 1, "1", tString, "FHIRPath expression to execute."),
 			in("context", 0, "1", tString, "Context expression to select focus items within the resource."),
 			variablesIn,
 			in("resource", 1, "1", tResource, "Resource to evaluate against. Alternatively provide as extension with http://fhir.forms-lab.com/StructureDefinition/json-value or http://fhir.forms-lab.com/StructureDefinition/xml-value."),
 			in("terminologyserver", 0, "1", tString, "Terminology cmd base URL for lookups, when not natively supported."),
-
-			// Outputs
-			parametersOut,
-			resultOut,
-			debugTraceOut,
-		},
+			in("echoResource", 0, "1", nil, "How to echo the resource in the 'parameters' output: valueBoolean (false omits it) or valueString 'full', 'hash' or 'omit'. Defaults to the server setting, usually 'full'."),
+			in("timing", 0, "1", ptr.To("boolean"), "Report the microseconds spent in each phase of the evaluation in a 'timing' part of the 'parameters' output."),
+		}, outputs...),
 	}
 }
 
+// prepareInputs sets the inputs configured on the backend rather than by the request.
+func (b *Backend) prepareInputs(inputs *evalInputs) {
+	inputs.store = b.Store
+	inputs.parseCache = b.ParseCache
+	inputs.defaultEcho = b.EchoResource
+}
+
 // Concrete invoke methods
 func (b *Backend) InvokeFHIRPath(ctx context.Context, parameters r4.Parameters) (r4.Parameters, error) {
 	return b.InvokeFHIRPathR4(ctx, parameters)
 }
 
-func (b *Backend) InvokeFHIRPathR4(ctx context.Context, parameters r4.Parameters) (r4.Parameters, error) {
-	inputs, err := parseParameters[model.R4](parameters)
+func (b *Backend) InvokeFHIRPathR4(ctx context.Context, parameters r4.Parameters) (_ r4.Parameters, err error) {
+	ctx, span := startSpan(ctx, "InvokeFHIRPathR4")
+	defer func() { endSpan(span, err) }()
+
+	inputs, err := parseParametersTraced[model.R4](ctx, parameters)
 	if err != nil {
 		return r4.Parameters{}, opErrR4("fatal", "processing", err.Error())
 	}
+	b.prepareInputs(&inputs)
 
 	result := evalFHIRPath[model.R4](ctx, inputs)
 	if result.error != nil {
 		return r4.Parameters{}, opErrR4("fatal", "processing", result.error.Error())
 	}
 
-	return buildR4Parameters[model.R4](result, inputs), nil
+	return buildTraced(ctx, "buildR4Parameters", result, func() r4.Parameters {
+		return buildR4Parameters[model.R4](result, inputs)
+	}), nil
 }
 
 // InvokeFHIRPathR4B must take r4 parameters, because these are parsed by the framework.
-// But we can return other types as long as they implement model.Resource.
-func (b *Backend) InvokeFHIRPathR4B(ctx context.Context, parameters r4.Parameters) (r4b.Parameters, error) {
-	inputs, err := parseParameters[model.R4B](parameters)
+// When served behind ReleaseParameters, the natively decoded R4B parameters are used instead.
+// We can return other types as long as they implement model.Resource.
+func (b *Backend) InvokeFHIRPathR4B(ctx context.Context, parameters r4.Parameters) (_ r4b.Parameters, err error) {
+	ctx, span := startSpan(ctx, "InvokeFHIRPathR4B")
+	defer func() { endSpan(span, err) }()
+
+	inputs, err := parseParametersTraced[model.R4B](ctx, nativeParameters(ctx, parameters))
 	if err != nil {
 		return r4b.Parameters{}, opErrR4B("fatal", "processing", err.Error())
 	}
+	b.prepareInputs(&inputs)
 
 	result := evalFHIRPath[model.R4B](ctx, inputs)
 	if result.error != nil {
 		return r4b.Parameters{}, opErrR4B("fatal", "processing", result.error.Error())
 	}
 
-	return buildR4BParameters[model.R4B](result, inputs), nil
+	return buildTraced(ctx, "buildR4BParameters", result, func() r4b.Parameters {
+		return buildR4BParameters[model.R4B](result, inputs)
+	}), nil
 }
 
-func (b *Backend) InvokeFHIRPathR5(ctx context.Context, parameters r4.Parameters) (r5.Parameters, error) {
-	inputs, err := parseParameters[model.R5](parameters)
+func (b *Backend) InvokeFHIRPathR5(ctx context.Context, parameters r4.Parameters) (_ r5.Parameters, err error) {
+	ctx, span := startSpan(ctx, "InvokeFHIRPathR5")
+	defer func() { endSpan(span, err) }()
+
+	inputs, err := parseParametersTraced[model.R5](ctx, nativeParameters(ctx, parameters))
 	if err != nil {
 		return r5.Parameters{}, opErrR5("fatal", "processing", err.Error())
 	}
+	b.prepareInputs(&inputs)
 
 	result := evalFHIRPath[model.R5](ctx, inputs)
 	if result.error != nil {
 		return r5.Parameters{}, opErrR5("fatal", "processing", result.error.Error())
 	}
 
-	return buildR5Parameters[model.R5](result, inputs), nil
+	return buildTraced(ctx, "buildR5Parameters", result, func() r5.Parameters {
+		return buildR5Parameters[model.R5](result, inputs)
+	}), nil
+}
+
+// InvokeFHIRPathAuto evaluates in the release detected from the submitted resource by ReleaseParameters.
+// Without detection (e.g. not served behind ReleaseParameters, or if it failed) it behaves like
+// $fhirpath and reports the fallback to R4 as a warning.
+func (b *Backend) InvokeFHIRPathAuto(ctx context.Context, parameters r4.Parameters) (_ model.Resource, err error) {
+	ctx, span := startSpan(ctx, "InvokeFHIRPathAuto")
+	defer func() { endSpan(span, err) }()
+
+	detection, ok := ctx.Value(releaseDetectionKey{}).(releaseDetection)
+	if !ok || detection.err != nil {
+		warning := "FHIR release was not detected, evaluated as R4"
+		if detection.err != nil {
+			warning = fmt.Sprintf("%v, evaluated as R4", detection.err)
+		}
+		detection = releaseDetection{release: "R4", params: parameters, warnings: []string{warning}}
+	}
+	span.SetAttributes(attribute.String("fhirpath.release", detection.release))
+
+	switch detection.release {
+	case "R4B":
+		inputs, err := parseParametersTraced[model.R4B](ctx, detection.params)
+		if err != nil {
+			return nil, opErrR4B("fatal", "processing", err.Error())
+		}
+		b.prepareInputs(&inputs)
+		inputs.detectedRelease = detection.release
+		inputs.warnings = detection.warnings
+
+		result := evalFHIRPath[model.R4B](ctx, inputs)
+		if result.error != nil {
+			return nil, opErrR4B("fatal", "processing", result.error.Error())
+		}
+		return buildTraced(ctx, "buildR4BParameters", result, func() r4b.Parameters {
+			return buildR4BParameters[model.R4B](result, inputs)
+		}), nil
+	case "R5":
+		inputs, err := parseParametersTraced[model.R5](ctx, detection.params)
+		if err != nil {
+			return nil, opErrR5("fatal", "processing", err.Error())
+		}
+		b.prepareInputs(&inputs)
+		inputs.detectedRelease = detection.release
+		inputs.warnings = detection.warnings
+
+		result := evalFHIRPath[model.R5](ctx, inputs)
+		if result.error != nil {
+			return nil, opErrR5("fatal", "processing", result.error.Error())
+		}
+		return buildTraced(ctx, "buildR5Parameters", result, func() r5.Parameters {
+			return buildR5Parameters[model.R5](result, inputs)
+		}), nil
+	default:
+		inputs, err := parseParametersTraced[model.R4](ctx, detection.params)
+		if err != nil {
+			return nil, opErrR4("fatal", "processing", err.Error())
+		}
+		b.prepareInputs(&inputs)
+		inputs.detectedRelease = detection.release
+		inputs.warnings = detection.warnings
+
+		result := evalFHIRPath[model.R4](ctx, inputs)
+		if result.error != nil {
+			return nil, opErrR4("fatal", "processing", result.error.Error())
+		}
+		return buildTraced(ctx, "buildR4Parameters", result, func() r4.Parameters {
+			return buildR4Parameters[model.R4](result, inputs)
+		}), nil
+	}
 }
 
 // Generic evaluation inputs and result
@@ -240,21 +385,51 @@ type evalInputs struct {
 	context    string
 	resource   model.Resource
 	variables  map[string]fhirpath.Collection
+	// store is the optional fallback for resolve(), not part of the request itself.
+	store *ResourceStore
+	// parseCache caches parsed expression and context, nil parses every time.
+	parseCache *ParseCache
+	// echoResource is how the resource is echoed as requested, defaultEcho the server default.
+	echoResource string
+	defaultEcho  string
+	// timing reports the time spent in each phase, decodeResource is the time spent decoding the
+	// request body and the resource, if passed in an extension.
+	timing         bool
+	decodeResource time.Duration
+	// detectedRelease is set when the release was detected from the resource ($fhirpath-auto).
+	detectedRelease string
+	// warnings found while decoding the inputs, e.g. elements unknown in the detected release.
+	warnings []string
 }
 
 type evalResult struct {
-	results []resultEntry
-	error   error
+	results  []resultEntry
+	warnings []string
+	timings  phaseTimings
+	error    error
 }
 
 type resultEntry struct {
 	contextPath string
 	values      fhirpath.Collection
 	traces      []traceEntry
+	// evaluation is the time spent evaluating the expression on the context item.
+	evaluation time.Duration
 }
 
 // Generic evaluation function
-func evalFHIRPath[R model.Release](ctx context.Context, inputs evalInputs) evalResult {
+func evalFHIRPath[R model.Release](ctx context.Context, inputs evalInputs) (result evalResult) {
+	ctx, span := startSpan(ctx, "evalFHIRPath")
+	defer func() {
+		span.SetAttributes(
+			attribute.String("fhirpath.release", model.ReleaseName[R]()),
+			attribute.Int("fhirpath.expression.length", len(inputs.expression)),
+			attribute.Int("fhirpath.context.items", len(result.results)),
+			attribute.Int("fhirpath.result.count", resultCount(result)),
+		)
+		endSpan(span, result.error)
+	}()
+
 	// Prepare evaluation context
 	var release R
 	switch any(release).(type) {
@@ -266,69 +441,123 @@ func evalFHIRPath[R model.Release](ctx context.Context, inputs evalInputs) evalR
 		ctx = r5.WithContext(ctx)
 	}
 
+	// Install resolve() backed by the submitted resource (contained resources and Bundle entries)
+	// and the local resource store, if configured
+	resolver := newReferenceResolver(inputs.resource)
+	if inputs.store != nil {
+		resolver.fallback = func(ref string) (model.Resource, error) {
+			return resolveFromStore[R](inputs.store, ref)
+		}
+	}
+	ctx = fhirpath.WithFunctions(ctx, fhirpath.Functions{"resolve": resolver.resolve})
+
 	resourceElem := inputs.resource.(fhirpath.Element)
 	ctx = fhirpath.WithEnv(ctx, "resource", fhirpath.Collection{resourceElem})
 	ctx = fhirpath.WithEnv(ctx, "rootResource", fhirpath.Collection{resourceElem})
+	ctx = fhirpath.WithEnv(ctx, "context", fhirpath.Collection{resourceElem})
+	ctx = withStandardEnv(ctx, inputs.expression, inputs.context)
 
 	for name, value := range inputs.variables {
 		ctx = fhirpath.WithEnv(ctx, name, value)
 	}
 
+	info := requestInfoFrom(ctx)
+	info.setRelease(model.ReleaseName[R]())
+	info.expression = inputs.expression
+	info.resource = inputs.resource
+
 	// If the expression is empty, don't attempt to parse/evaluate; return no results.
+	var timings phaseTimings
 	if strings.TrimSpace(inputs.expression) == "" {
-		return evalResult{results: nil}
+		return evalResult{warnings: resolver.warnings, timings: timings}
 	}
 
 	// Parse expressions
-	exprParsed, err := fhirpath.Parse(inputs.expression)
+	releaseName := model.ReleaseName[R]()
+	start := time.Now()
+	exprParsed, err := inputs.parseCache.Parse(releaseName, inputs.expression)
+	timings.parseExpression = time.Since(start)
+	info.parse += timings.parseExpression
 	if err != nil {
+		info.errorClass = "parse"
 		return evalResult{error: fmt.Errorf("expression parse error: %w", err)}
 	}
 
 	var results []resultEntry
 	if strings.TrimSpace(inputs.context) != "" {
 		// Evaluate context expression on the resource
-		ctxExpr, err := fhirpath.Parse(inputs.context)
+		start := time.Now()
+		ctxExpr, err := inputs.parseCache.Parse(releaseName, inputs.context)
+		timings.parseContext = time.Since(start)
+		info.parse += timings.parseContext
 		if err != nil {
+			info.errorClass = "parse"
 			return evalResult{error: fmt.Errorf("context parse error: %w", err)}
 		}
+		start = time.Now()
 		ctxItems, err := fhirpath.Evaluate(ctx, inputs.resource.(fhirpath.Element), ctxExpr)
+		timings.evaluateContext = time.Since(start)
+		info.evaluation += timings.evaluateContext
 		if err != nil {
+			info.errorClass = "evaluation"
 			return evalResult{error: fmt.Errorf("context evaluation error: %w", err)}
 		}
 
-		// Evaluate main expression for each context item
+		// Evaluate main expression for each context item, with %resource/%rootResource
+		// bound to the resources enclosing the item (e.g. contained resources, Bundle entries).
+		// Locating the item is only worth it if the expression refers to these variables.
+		scoped := scopedVariable.MatchString(inputs.expression)
 		for i, item := range ctxItems {
+			resolver.focus = item
+
 			tracer := &fpTracer{}
 			evCtx := fhirpath.WithTracer(ctx, tracer)
+			if scoped {
+				scope := resolver.scopeOf(item)
+				evCtx = fhirpath.WithEnv(evCtx, "resource", fhirpath.Collection{scope.resource})
+				evCtx = fhirpath.WithEnv(evCtx, "rootResource", fhirpath.Collection{scope.rootResource})
+			}
+			evCtx = fhirpath.WithEnv(evCtx, "context", fhirpath.Collection{item})
+			start := time.Now()
 			val, err := fhirpath.Evaluate(evCtx, item, exprParsed)
+			evaluation := time.Since(start)
+			info.evaluation += evaluation
 			if err != nil {
+				info.errorClass = "evaluation"
 				return evalResult{error: fmt.Errorf("evaluation error: %w", err)}
 			}
+			info.results += len(val)
 
 			contextPath := fmt.Sprintf("%s.%s[%d]", inputs.resource.ResourceType(), inputs.context, i)
 			results = append(results, resultEntry{
 				contextPath: contextPath,
 				values:      val,
 				traces:      tracer.entries,
+				evaluation:  evaluation,
 			})
 		}
 	} else {
 		// Evaluate directly on the resource
 		tracer := &fpTracer{}
 		evCtx := fhirpath.WithTracer(ctx, tracer)
+		start := time.Now()
 		val, err := fhirpath.Evaluate(evCtx, inputs.resource.(fhirpath.Element), exprParsed)
+		evaluation := time.Since(start)
+		info.evaluation += evaluation
 		if err != nil {
+			info.errorClass = "evaluation"
 			return evalResult{error: fmt.Errorf("evaluation error: %w", err)}
 		}
+		info.results += len(val)
 
 		results = append(results, resultEntry{
-			values: val,
-			traces: tracer.entries,
+			values:     val,
+			traces:     tracer.entries,
+			evaluation: evaluation,
 		})
 	}
 
-	return evalResult{results: results}
+	return evalResult{results: results, warnings: resolver.warnings, timings: timings}
 }
 
 // parseParameters extracts evaluation inputs from Parameters resource.
@@ -384,31 +613,45 @@ func parseParameters[R model.Release](parameters fhirpath.Element) (evalInputs,
 	}
 
 	var resourceElem model.Resource
+	var decodeResource time.Duration
 
-	// Check for json-value extension
+	// Check for json-value or xml-value extension
 	extensions := resParam.Children("extension")
 	for _, ext := range extensions {
 		urlChildren := ext.Children("url")
-		if len(urlChildren) > 0 {
-			if urlStr, ok, _ := urlChildren[0].ToString(false); ok &&
-				string(urlStr) == "http://fhir.forms-lab.com/StructureDefinition/json-value" {
-				// Found json-value extension, decode the JSON
-				valueChildren := ext.Children("value")
-				if len(valueChildren) > 0 {
-					if jsonStr, ok, _ := valueChildren[0].ToString(false); ok {
-						decoded, err := decodeResourceFromJSON[R](string(jsonStr))
-						if err != nil {
-							return evalInputs{}, fmt.Errorf("failed to decode resource from json-value extension: %w", err)
-						}
-						resourceElem = decoded
-						break
-					}
+		if len(urlChildren) == 0 {
+			continue
+		}
+		urlStr, ok, _ := urlChildren[0].ToString(false)
+		if !ok {
+			continue
+		}
+		var extName string
+		var decode func(string) (model.Resource, error)
+		switch string(urlStr) {
+		case "http://fhir.forms-lab.com/StructureDefinition/json-value":
+			extName, decode = "json-value", decodeResourceFromJSON[R]
+		case "http://fhir.forms-lab.com/StructureDefinition/xml-value":
+			extName, decode = "xml-value", decodeResourceFromXML[R]
+		default:
+			continue
+		}
+		valueChildren := ext.Children("value")
+		if len(valueChildren) > 0 {
+			if str, ok, _ := valueChildren[0].ToString(false); ok {
+				start := time.Now()
+				decoded, err := decode(string(str))
+				decodeResource = time.Since(start)
+				if err != nil {
+					return evalInputs{}, fmt.Errorf("failed to decode resource from %s extension: %w", extName, err)
 				}
+				resourceElem = decoded
+				break
 			}
 		}
 	}
 
-	// If no json-value extension, try the resource field directly
+	// If no json-value/xml-value extension, try the resource field directly
 	if resourceElem == nil {
 		resourceList := resParam.Children("resource")
 		if len(resourceList) == 0 {
@@ -446,11 +689,37 @@ func parseParameters[R model.Release](parameters fhirpath.Element) (evalInputs,
 		}
 	}
 
+	// Extract optional echoResource
+	var echoResource string
+	if echoParam, ok := findParam("echoResource"); ok {
+		if echoValue := echoParam.Children("value"); len(echoValue) > 0 {
+			echoResource, err = parseEchoResource(echoValue[0])
+			if err != nil {
+				return evalInputs{}, err
+			}
+		}
+	}
+
+	// Extract optional timing
+	var timing bool
+	if timingParam, ok := findParam("timing"); ok {
+		if timingValue := timingParam.Children("value"); len(timingValue) > 0 {
+			b, ok, err := timingValue[0].ToBoolean(false)
+			if err != nil || !ok {
+				return evalInputs{}, fmt.Errorf("invalid 'timing' parameter, use a boolean")
+			}
+			timing = bool(b)
+		}
+	}
+
 	return evalInputs{
-		expression: string(exprStr),
-		context:    contextExprStr,
-		resource:   resourceElem,
-		variables:  variables,
+		expression:     string(exprStr),
+		context:        contextExprStr,
+		resource:       resourceElem,
+		variables:      variables,
+		echoResource:   echoResource,
+		timing:         timing,
+		decodeResource: decodeResource,
 	}, nil
 }
 
@@ -486,6 +755,54 @@ func decodeResourceFromJSON[R model.Release](jsonStr string) (model.Resource, er
 	return resource, nil
 }
 
+// xmlDecodeError reports a failure to decode FHIR XML and the input offset the decoder stopped at.
+type xmlDecodeError struct {
+	err    error
+	offset int64
+}
+
+func (e *xmlDecodeError) Error() string {
+	return "failed to unmarshal resource XML: " + e.err.Error()
+}
+
+func (e *xmlDecodeError) Unwrap() error {
+	return e.err
+}
+
+// decodeResourceFromXML decodes a FHIR XML string into a release-specific resource
+func decodeResourceFromXML[R model.Release](xmlStr string) (model.Resource, error) {
+	var release R
+	var resource model.Resource
+	var err error
+
+	dec := xml.NewDecoder(strings.NewReader(xmlStr))
+
+	switch any(release).(type) {
+	case model.R4:
+		var r4Res r4.ContainedResource
+		err = dec.Decode(&r4Res)
+		resource = r4Res.Resource
+	case model.R4B:
+		var r4bRes r4b.ContainedResource
+		err = dec.Decode(&r4bRes)
+		resource = r4bRes.Resource
+	case model.R5:
+		var r5Res r5.ContainedResource
+		err = dec.Decode(&r5Res)
+		resource = r5Res.Resource
+	default:
+		return nil, fmt.Errorf("unsupported release type")
+	}
+
+	if err != nil {
+		return nil, &xmlDecodeError{err: err, offset: dec.InputOffset()}
+	}
+	if resource == nil {
+		return nil, fmt.Errorf("failed to unmarshal resource XML: no resource found")
+	}
+	return resource, nil
+}
+
 func typeNameOf(e fhirpath.Element) string {
 	if ti := e.TypeInfo(); ti != nil {
 		if q, ok := ti.QualifiedName(); ok && q.Name != "" {
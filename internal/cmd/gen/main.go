@@ -8,6 +8,8 @@ import (
 type Release struct {
 	Release     string
 	PackageName string
+	// Primitives are the model types of the primitive data types that may have extensions (all but xhtml).
+	Primitives []string
 }
 
 type Data struct {
@@ -15,11 +17,15 @@ type Data struct {
 }
 
 func main() {
+	primitives := []string{
+		"Base64Binary", "Boolean", "Canonical", "Code", "Date", "DateTime", "Decimal", "Id", "Instant", "Integer",
+		"Markdown", "Oid", "PositiveInt", "String", "Time", "UnsignedInt", "Uri", "Url", "Uuid",
+	}
 	data := Data{
 		Releases: []Release{
-			{Release: "R4", PackageName: "r4"},
-			{Release: "R4B", PackageName: "r4b"},
-			{Release: "R5", PackageName: "r5"},
+			{Release: "R4", PackageName: "r4", Primitives: primitives},
+			{Release: "R4B", PackageName: "r4b", Primitives: primitives},
+			{Release: "R5", PackageName: "r5", Primitives: append([]string{"Integer64"}, primitives...)},
 		},
 	}
 
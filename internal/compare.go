@@ -0,0 +1,472 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"github.com/damedic/fhir-toolbox-go/model/gen/r4"
+	"github.com/damedic/fhir-toolbox-go/utils/ptr"
+	"strings"
+)
+
+type compareParametersKey struct{}
+
+// compareParameters holds the request Parameters decoded in every release for $fhirpath-compare.
+// Releases the request could not be decoded in have an entry in errs instead.
+type compareParameters struct {
+	params map[string]fhirpath.Element
+	errs   map[string]error
+}
+
+// releaseOutcome is the evaluation of a $fhirpath-compare request in a single release.
+type releaseOutcome struct {
+	release string
+	result  evalResult
+	// output is the release's regular response, converted to R4 Parameters.
+	output r4.Parameters
+	// representations are the value[x] types the result values have in the release's own response,
+	// per context item, e.g. "valueInteger64", or "json-value" for values emitted as extension.
+	representations [][]string
+	// warnings are reported in addition to those of the evaluation, e.g. results not representable in R4.
+	warnings []string
+	err      error
+}
+
+// InvokeFHIRPathCompare evaluates the request in R4, R4B and R5 and returns the results side by side,
+// together with the differences between every pair of releases.
+func (b *Backend) InvokeFHIRPathCompare(ctx context.Context, parameters r4.Parameters) (_ r4.Parameters, err error) {
+	ctx, span := startSpan(ctx, "InvokeFHIRPathCompare")
+	defer func() { endSpan(span, err) }()
+
+	cp, ok := ctx.Value(compareParametersKey{}).(compareParameters)
+	if !ok {
+		// Not served behind ReleaseParameters, all releases evaluate the R4 parameters.
+		cp = compareParameters{params: map[string]fhirpath.Element{"R4": parameters, "R4B": parameters, "R5": parameters}}
+	}
+
+	outcomes := []releaseOutcome{
+		compareRelease[model.R4](ctx, b, cp),
+		compareRelease[model.R4B](ctx, b, cp),
+		compareRelease[model.R5](ctx, b, cp),
+	}
+
+	// Fail like the other operations if no release was able to evaluate the request
+	failed := 0
+	for _, o := range outcomes {
+		if o.err != nil {
+			failed++
+		}
+	}
+	if failed == len(outcomes) {
+		return r4.Parameters{}, opErrR4("fatal", "processing", outcomes[0].err.Error())
+	}
+
+	return buildCompareParameters(outcomes), nil
+}
+
+func compareRelease[R model.Release](ctx context.Context, b *Backend, cp compareParameters) releaseOutcome {
+	release := model.ReleaseName[R]()
+	outcome := releaseOutcome{release: release}
+
+	params, ok := cp.params[release]
+	if !ok {
+		outcome.err = cp.errs[release]
+		if outcome.err == nil {
+			outcome.err = fmt.Errorf("request could not be decoded in %s", release)
+		}
+		return outcome
+	}
+
+	inputs, err := parseParametersTraced[R](ctx, params)
+	if err != nil {
+		outcome.err = err
+		return outcome
+	}
+	b.prepareInputs(&inputs)
+
+	outcome.result = evalFHIRPath[R](ctx, inputs)
+	if outcome.result.error != nil {
+		outcome.err = outcome.result.error
+		return outcome
+	}
+
+	outcome.output = buildTraced(ctx, "buildParameters", outcome.result, func() r4.Parameters {
+		native := buildParameters[R](outcome.result, inputs)
+		outcome.representations = resultRepresentations(native)
+		output, err := toR4Parameters(native)
+		if err != nil {
+			// Values without an R4 type, e.g. R5 integer64, are converted and reported in the diff
+			outcome.warnings = append(outcome.warnings, err.Error())
+		}
+		return output
+	})
+	return outcome
+}
+
+// buildParameters builds the regular response of release R.
+func buildParameters[R model.Release](result evalResult, inputs evalInputs) model.Resource {
+	var release R
+	switch any(release).(type) {
+	case model.R4B:
+		return buildR4BParameters[R](result, inputs)
+	case model.R5:
+		return buildR5Parameters[R](result, inputs)
+	default:
+		return buildR4Parameters[R](result, inputs)
+	}
+}
+
+// toR4Parameters converts release-specific Parameters to R4 via JSON, which is identical for the
+// parameter structure and all data types shared by the releases. Parts without an R4 representation
+// are converted (see fitR4Parameter) and reported in the error, together with parts that could not
+// be converted and were dropped. The converted Parameters are returned nonetheless.
+func toR4Parameters(res model.Resource) (r4.Parameters, error) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return r4.Parameters{}, err
+	}
+	p, err := decodeR4Parameters(data)
+	if err == nil {
+		return p, nil
+	}
+	convErr := fmt.Errorf("result not representable in R4 as is, converted to R4 types: %w", err)
+
+	var doc struct {
+		Parameter []json.RawMessage `json:"parameter"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return r4.Parameters{}, convErr
+	}
+	var kept []json.RawMessage
+	dropped := false
+	for _, param := range doc.Parameter {
+		if fitted, ok := fitR4Parameter(param); ok {
+			kept = append(kept, fitted)
+		} else {
+			dropped = true
+		}
+	}
+	if dropped {
+		convErr = fmt.Errorf("result not representable in R4, parts without an R4 type are left out: %w", err)
+	}
+	data, err = json.Marshal(map[string]any{"resourceType": "Parameters", "parameter": kept})
+	if err != nil {
+		return r4.Parameters{}, convErr
+	}
+	p, err = decodeR4Parameters(data)
+	if err != nil {
+		return r4.Parameters{}, convErr
+	}
+	return p, convErr
+}
+
+// fitR4Parameter returns the JSON of a parameter in terms of R4, false if the parameter can't be
+// represented at all. An integer64 value becomes the exact integral valueDecimal, like System.Long
+// results in R4, any other value or resource without an R4 type moves to the json-value extension,
+// like complex results do. The fhirpath-type extension of the part keeps recording the original type.
+func fitR4Parameter(param json.RawMessage) (json.RawMessage, bool) {
+	if _, err := decodeR4Parameters(singleParameter(param)); err == nil {
+		return param, true
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(param, &fields); err != nil {
+		return nil, false
+	}
+
+	if value, ok := fields["valueInteger64"]; ok {
+		var lexical string
+		if err := json.Unmarshal(value, &lexical); err != nil {
+			return nil, false
+		}
+		fields["valueDecimal"] = json.RawMessage(lexical)
+		if meta, ok := fields["_valueInteger64"]; ok {
+			fields["_valueDecimal"] = meta
+		}
+		delete(fields, "valueInteger64")
+		delete(fields, "_valueInteger64")
+	}
+	for key, value := range fields {
+		if key != "resource" && !strings.HasPrefix(key, "value") {
+			continue
+		}
+		probe, _ := json.Marshal(map[string]json.RawMessage{"name": json.RawMessage(`"probe"`), key: value})
+		if _, err := decodeR4Parameters(singleParameter(probe)); err == nil {
+			continue
+		}
+		var extensions []json.RawMessage
+		if ext, ok := fields["extension"]; ok {
+			if err := json.Unmarshal(ext, &extensions); err != nil {
+				return nil, false
+			}
+		}
+		jsonValue, _ := json.Marshal(map[string]string{
+			"url":         "http://fhir.forms-lab.com/StructureDefinition/json-value",
+			"valueString": string(value),
+		})
+		fields["extension"], _ = json.Marshal(append([]json.RawMessage{jsonValue}, extensions...))
+		delete(fields, key)
+		delete(fields, "_"+key)
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(fields["part"], &parts); err == nil && len(parts) > 0 {
+		var kept []json.RawMessage
+		for _, part := range parts {
+			if fitted, ok := fitR4Parameter(part); ok {
+				kept = append(kept, fitted)
+			}
+		}
+		delete(fields, "part")
+		if len(kept) > 0 {
+			fields["part"], _ = json.Marshal(kept)
+		}
+	}
+
+	fitted, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := decodeR4Parameters(singleParameter(fitted)); err != nil {
+		return nil, false
+	}
+	return fitted, true
+}
+
+// resultRepresentations lists the value[x] type of every result value in a response, per result
+// parameter. Trace parts are not result values and are skipped.
+func resultRepresentations(res model.Resource) [][]string {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return nil
+	}
+	var doc struct {
+		Parameter []struct {
+			Name string                       `json:"name"`
+			Part []map[string]json.RawMessage `json:"part"`
+		} `json:"parameter"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+	var representations [][]string
+	for _, param := range doc.Parameter {
+		if param.Name != "result" {
+			continue
+		}
+		var values []string
+		for _, part := range param.Part {
+			var name string
+			if err := json.Unmarshal(part["name"], &name); err == nil && name == "trace" {
+				continue
+			}
+			values = append(values, partRepresentation(part))
+		}
+		representations = append(representations, values)
+	}
+	return representations
+}
+
+// partRepresentation returns the value[x] key of a part, or "json-value" if it has none.
+func partRepresentation(part map[string]json.RawMessage) string {
+	for key := range part {
+		if strings.HasPrefix(key, "value") {
+			return key
+		}
+	}
+	return "json-value"
+}
+
+// singleParameter wraps the JSON of a parameter in a Parameters resource.
+func singleParameter(param json.RawMessage) []byte {
+	return []byte(`{"resourceType":"Parameters","parameter":[` + string(param) + `]}`)
+}
+
+func decodeR4Parameters(data []byte) (r4.Parameters, error) {
+	converted, err := decodeResourceFromJSON[model.R4](string(data))
+	if err != nil {
+		return r4.Parameters{}, err
+	}
+	p, ok := converted.(r4.Parameters)
+	if !ok {
+		return r4.Parameters{}, fmt.Errorf("unexpected %s result", converted.ResourceType())
+	}
+	return p, nil
+}
+
+func buildCompareParameters(outcomes []releaseOutcome) r4.Parameters {
+	out := r4.Parameters{}
+
+	releases := make([]string, 0, len(outcomes))
+	for _, o := range outcomes {
+		releases = append(releases, o.release)
+	}
+	evalLabel := fmt.Sprintf("fhir-toolbox-go (%s)", strings.Join(releases, ", "))
+
+	// Echo the inputs of the first release that succeeded, warnings are reported per release
+	for _, o := range outcomes {
+		if o.err != nil || len(o.output.Parameter) == 0 {
+			continue
+		}
+		if p, ok := findR4Parameter(o.output.Parameter, "parameters"); ok {
+			paramsPart := r4.ParametersParameter{Name: p.Name}
+			for _, part := range p.Part {
+				switch parameterName(part) {
+				case "warnings":
+					continue
+				case "evaluator":
+					part.Value = r4.String{Value: &evalLabel}
+				}
+				paramsPart.Part = append(paramsPart.Part, part)
+			}
+			out.Parameter = append(out.Parameter, paramsPart)
+		}
+		break
+	}
+
+	for _, o := range outcomes {
+		releaseParam := r4.ParametersParameter{
+			Name:  r4.String{Value: ptr.To("release")},
+			Value: r4.String{Value: ptr.To(o.release)},
+		}
+		if o.err != nil {
+			releaseParam.Part = append(releaseParam.Part, r4.ParametersParameter{
+				Name:  r4.String{Value: ptr.To("error")},
+				Value: r4.String{Value: ptr.To(o.err.Error())},
+			})
+		}
+		warningsParam := r4.ParametersParameter{Name: r4.String{Value: ptr.To("warnings")}}
+		for _, p := range o.output.Parameter {
+			switch parameterName(p) {
+			case "result":
+				releaseParam.Part = append(releaseParam.Part, p)
+			case "parameters":
+				if w, ok := findR4Parameter(p.Part, "warnings"); ok {
+					warningsParam.Part = append(warningsParam.Part, w.Part...)
+				}
+			}
+		}
+		for _, w := range o.warnings {
+			warningsParam.Part = append(warningsParam.Part, r4.ParametersParameter{
+				Name:  r4.String{Value: ptr.To("warning")},
+				Value: r4.String{Value: ptr.To(w)},
+			})
+		}
+		if len(warningsParam.Part) > 0 {
+			releaseParam.Part = append(releaseParam.Part, warningsParam)
+		}
+		out.Parameter = append(out.Parameter, releaseParam)
+	}
+
+	diffParam := r4.ParametersParameter{Name: r4.String{Value: ptr.To("diff")}}
+	for i, base := range outcomes {
+		for _, o := range outcomes[i+1:] {
+			diffParam.Part = append(diffParam.Part, diffOutcomes(base, o)...)
+		}
+	}
+	out.Parameter = append(out.Parameter, diffParam)
+
+	return out
+}
+
+func findR4Parameter(params []r4.ParametersParameter, name string) (r4.ParametersParameter, bool) {
+	for _, p := range params {
+		if parameterName(p) == name {
+			return p, true
+		}
+	}
+	return r4.ParametersParameter{}, false
+}
+
+// parameterName returns the name of a parameter, empty if it has none.
+func parameterName(p r4.ParametersParameter) string {
+	if p.Name.Value == nil {
+		return ""
+	}
+	return *p.Name.Value
+}
+
+// diffOutcomes lists the differences of other relative to base: failures, the context items evaluated,
+// and per context item the number, types and values of the results, and the FHIR types the results
+// are emitted as, e.g. integer64 in R5 but decimal in R4 for a System.Long.
+func diffOutcomes(base, other releaseOutcome) []r4.ParametersParameter {
+	var diffs []r4.ParametersParameter
+	add := func(kind, contextPath string, index int, baseRepr, otherRepr string) {
+		d := r4.ParametersParameter{
+			Name:  r4.String{Value: ptr.To("difference")},
+			Value: r4.String{Value: ptr.To(kind)},
+			Part: []r4.ParametersParameter{
+				{Name: r4.String{Value: ptr.To("base")}, Value: r4.String{Value: ptr.To(base.release)}},
+				{Name: r4.String{Value: ptr.To("release")}, Value: r4.String{Value: ptr.To(other.release)}},
+			},
+		}
+		if contextPath != "" {
+			d.Part = append(d.Part, r4.ParametersParameter{Name: r4.String{Value: ptr.To("context")}, Value: r4.String{Value: ptr.To(contextPath)}})
+		}
+		if index >= 0 {
+			d.Part = append(d.Part, r4.ParametersParameter{Name: r4.String{Value: ptr.To("index")}, Value: r4.Integer{Value: ptr.To(int32(index))}})
+		}
+		d.Part = append(d.Part,
+			r4.ParametersParameter{Name: r4.String{Value: ptr.To(base.release)}, Value: r4.String{Value: ptr.To(baseRepr)}},
+			r4.ParametersParameter{Name: r4.String{Value: ptr.To(other.release)}, Value: r4.String{Value: ptr.To(otherRepr)}},
+		)
+		diffs = append(diffs, d)
+	}
+
+	if base.err != nil || other.err != nil {
+		if base.err == nil || other.err == nil || base.err.Error() != other.err.Error() {
+			add("error", "", -1, outcomeStatus(base), outcomeStatus(other))
+		}
+		return diffs
+	}
+
+	baseResults, otherResults := base.result.results, other.result.results
+	if len(baseResults) != len(otherResults) {
+		add("context", "", -1, fmt.Sprint(len(baseResults)), fmt.Sprint(len(otherResults)))
+		return diffs
+	}
+
+	for i, b := range baseResults {
+		o := otherResults[i]
+		if len(b.values) != len(o.values) {
+			add("count", b.contextPath, -1, fmt.Sprint(len(b.values)), fmt.Sprint(len(o.values)))
+			continue
+		}
+		for j, bv := range b.values {
+			ov := o.values[j]
+			if bt, ot := typeNameOf(bv), typeNameOf(ov); bt != ot {
+				add("type", b.contextPath, j, bt, ot)
+			} else if bj, oj := valueJSON(bv), valueJSON(ov); bj != oj {
+				add("value", b.contextPath, j, bj, oj)
+			} else if bRep, oRep := representation(base, i, j), representation(other, i, j); bRep != oRep {
+				add("representation", b.contextPath, j, bRep, oRep)
+			}
+		}
+	}
+	return diffs
+}
+
+// representation returns the value[x] type of value j of context item i in the release's response.
+func representation(o releaseOutcome, i, j int) string {
+	if i >= len(o.representations) || j >= len(o.representations[i]) {
+		return ""
+	}
+	return o.representations[i][j]
+}
+
+func outcomeStatus(o releaseOutcome) string {
+	if o.err != nil {
+		return o.err.Error()
+	}
+	return "ok"
+}
+
+// valueJSON renders a result value for comparison across releases.
+func valueJSON(v fhirpath.Element) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig controls compression of responses and decompression of request bodies.
+type CompressionConfig struct {
+	// Enabled compresses responses for clients accepting gzip or deflate.
+	Enabled bool `json:"enabled"`
+	// MinSize is the response size in bytes from which responses are compressed.
+	MinSize int `json:"minSize"`
+	// Level is the compression level, 1 (fastest) to 9 (smallest), -1 for the default.
+	Level int `json:"level"`
+}
+
+func (c CompressionConfig) validate() []error {
+	var errs []error
+	if c.MinSize < 0 {
+		errs = append(errs, errors.New("compression.minSize must not be negative"))
+	}
+	if c.Level != flate.DefaultCompression && (c.Level < flate.BestSpeed || c.Level > flate.BestCompression) {
+		errs = append(errs, fmt.Errorf("compression.level must be -1 or between %d and %d", flate.BestSpeed, flate.BestCompression))
+	}
+	return errs
+}
+
+// Compress decompresses gzip and deflate encoded request bodies and compresses responses of at
+// least MinSize bytes with the encoding preferred by the client's Accept-Encoding.
+//
+// Responses echo the submitted resource and embed results as JSON strings, so they are often
+// larger than the request and compress well. Compress runs before MaxBodySize, which then limits
+// the decompressed body.
+func Compress(config CompressionConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+				body, err := decompressedBody(encoding, r.Body)
+				if err != nil {
+					writeOperationOutcome(w, http.StatusUnsupportedMediaType, "not-supported", err.Error())
+					return
+				}
+				r.Body = body
+				r.ContentLength = -1
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+			}
+
+			if !config.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := acceptedEncoding(r.Header.Values("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: config.MinSize, level: config.Level}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// decompressedBody returns a reader decompressing body in the given Content-Encoding.
+func decompressedBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip request body: %w", err)
+		}
+		return readCloser{zr, body}, nil
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deflate request body: %w", err)
+		}
+		return readCloser{zr, body}, nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q, use gzip or deflate", encoding)
+}
+
+// readCloser reads from a decompressor and closes the underlying body.
+type readCloser struct {
+	io.Reader
+	body io.Closer
+}
+
+func (rc readCloser) Close() error {
+	return rc.body.Close()
+}
+
+// acceptedEncoding picks gzip or deflate by q-value from Accept-Encoding headers, preferring gzip
+// on ties. A wildcard accepts gzip.
+func acceptedEncoding(values []string) string {
+	best, bestQ := "", 0.0
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			q := 1.0
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+			switch coding {
+			case "*", "x-gzip":
+				coding = "gzip"
+			case "gzip", "deflate":
+			default:
+				continue
+			}
+			if q > bestQ || (q == bestQ && coding == "gzip") {
+				best, bestQ = coding, q
+			}
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the first minSize bytes of a response to decide whether it is worth
+// compressing, then writes it compressed or as is.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	level    int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	zw      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.decided {
+		return w.write(p)
+	}
+	w.buf.Write(p)
+	if w.buf.Len() >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *compressWriter) write(p []byte) (int, error) {
+	if w.zw != nil {
+		return w.zw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide writes the header, compressed if the response is large enough and compressible, and
+// then the bytes held back.
+func (w *compressWriter) decide(large bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if large && compressible(w.status, h) {
+		var err error
+		switch w.encoding {
+		case "gzip":
+			w.zw, err = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+		case "deflate":
+			w.zw, err = zlib.NewWriterLevel(w.ResponseWriter, w.level)
+		}
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		// The representation changed, so a strong ETag no longer applies
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	_, err := w.write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// compressible reports whether a response with status and header should be compressed.
+func compressible(status int, h http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		// Unknown content is usually text, e.g. http.Error without a Content-Type
+		return h.Get("Content-Type") == ""
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml")
+}
+
+// Flush sends what was written so far, compressed if decided so.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(w.buf.Len() > 0)
+	}
+	if f, ok := w.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close completes the response, writing what was held back.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			// Nothing written, let the server write its default response
+			return nil
+		}
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
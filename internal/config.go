@@ -0,0 +1,495 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modes of the command, selected by flags.
+const (
+	// ModeServe runs the server.
+	ModeServe = "serve"
+	// ModePrintConfig prints the effective configuration as JSON, secrets redacted.
+	ModePrintConfig = "print-config"
+	// ModeCheckConfig validates the configuration and loads everything it refers to (store, keys,
+	// certificates) without serving.
+	ModeCheckConfig = "check-config"
+)
+
+// Config is the complete server configuration.
+//
+// It is layered by LoadConfig: defaults, then a YAML, TOML or JSON file, then environment
+// variables, then command line flags. All formats use the JSON field names below.
+type Config struct {
+	// Mode is what the command does with the configuration, see ModeServe. It is only set by flags.
+	Mode string `json:"-"`
+	// Addr is the listen address, e.g. ":3001" or "127.0.0.1:3001".
+	Addr string `json:"addr"`
+	// Store is an optional directory of FHIR JSON resources used by resolve().
+	Store string `json:"store,omitempty"`
+	// ParseCache is the number of parsed expressions to cache, 0 disables the cache.
+	ParseCache int `json:"parseCache"`
+	// ParseCacheBytes bounds the total length of the cached expressions, 0 for no bound.
+	ParseCacheBytes int64 `json:"parseCacheBytes"`
+	// EchoResource is how responses echo the submitted resource unless requested otherwise:
+	// "full", "hash" or "omit".
+	EchoResource  string              `json:"echoResource"`
+	ResponseCache ResponseCacheConfig `json:"responseCache"`
+	Log           LogConfig           `json:"log"`
+	Server        ServerConfig        `json:"server"`
+	Compression   CompressionConfig   `json:"compression"`
+	CORS          CORSConfig          `json:"cors"`
+	TLS           TLSConfig           `json:"tls"`
+	Auth          AuthConfig          `json:"auth"`
+	Throttle      ThrottleConfig      `json:"throttle"`
+	Tracing       TracingConfig       `json:"tracing"`
+}
+
+// ServerConfig holds the HTTP server timeouts and limits.
+type ServerConfig struct {
+	ReadTimeout       Duration `json:"readTimeout"`
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	// ShutdownTimeout bounds draining in-flight requests on SIGTERM/SIGINT.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	MaxHeaderBytes  int      `json:"maxHeaderBytes"`
+	// MaxBodyBytes limits request bodies, 0 for no limit.
+	MaxBodyBytes int64 `json:"maxBodyBytes"`
+	// HTTP2 enables HTTP/2, negotiated via ALPN when serving TLS.
+	HTTP2 bool `json:"http2"`
+}
+
+// DefaultConfig returns the configuration used for everything not configured explicitly.
+func DefaultConfig() Config {
+	return Config{
+		Mode:            ModeServe,
+		Addr:            ":3001",
+		ParseCache:      1024,
+		ParseCacheBytes: 1 << 20,
+		EchoResource:    EchoResourceFull,
+		ResponseCache: ResponseCacheConfig{
+			MaxBytes: 64 << 20,
+			TTL:      Duration(10 * time.Minute),
+			DiskSize: 10000,
+		},
+		Server: ServerConfig{
+			ReadTimeout:       Duration(30 * time.Second),
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			WriteTimeout:      Duration(60 * time.Second),
+			IdleTimeout:       Duration(120 * time.Second),
+			ShutdownTimeout:   Duration(30 * time.Second),
+			MaxHeaderBytes:    64 << 10,
+			MaxBodyBytes:      10 << 20,
+			HTTP2:             true,
+		},
+		Compression: CompressionConfig{Enabled: true, MinSize: 1024, Level: -1},
+		CORS:        DefaultCORSConfig(),
+		Throttle: ThrottleConfig{
+			// Without ClientIPHeader clients behind a proxy share its address, so the per-client
+			// limit is left to deployments that know their proxy (see fly.toml)
+			PerClient:     RateLimit{Burst: 20},
+			MaxConcurrent: 16,
+			MaxQueue:      100,
+			QueueTimeout:  Duration(10 * time.Second),
+		},
+		Tracing: TracingConfig{
+			ServiceName:    "fhirpath-lab-go",
+			SampleRatio:    1,
+			ExportInterval: Duration(5 * time.Second),
+		},
+	}
+}
+
+// envPrefix prefixes the environment variable of every setting, e.g. FHIRPATH_LAB_READ_TIMEOUT.
+const envPrefix = "FHIRPATH_LAB_"
+
+// setting is a configuration value settable by flag and environment variable.
+type setting struct {
+	// name is the flag name, the environment variable is derived from it.
+	name  string
+	usage string
+	// isBool allows the flag without value, e.g. -log-resources.
+	isBool bool
+	set    func(c *Config, value string) error
+	get    func(c *Config) string
+}
+
+var settings = []setting{
+	stringSetting("addr", "listen address, e.g. :3001 or 127.0.0.1:3001 (PORT is honoured as well)", func(c *Config) *string { return &c.Addr }),
+	stringSetting("store", "directory of FHIR JSON resources used by resolve() for references not found in the input", func(c *Config) *string { return &c.Store }),
+	intSetting("parse-cache", "number of parsed expressions to cache (0 disables the cache)", func(c *Config) *int { return &c.ParseCache }),
+	int64Setting("parse-cache-bytes", "maximum total length of the cached expressions (0 for no limit)", func(c *Config) *int64 { return &c.ParseCacheBytes }),
+	stringSetting("echo-resource", `how responses echo the resource unless requested otherwise: "full", "hash" or "omit"`, func(c *Config) *string { return &c.EchoResource }),
+	intSetting("response-cache", "number of responses to cache in memory (0 disables the cache)", func(c *Config) *int { return &c.ResponseCache.Size }),
+	int64Setting("response-cache-bytes", "maximum total size of the responses cached in memory (0 for no limit)", func(c *Config) *int64 { return &c.ResponseCache.MaxBytes }),
+	durationSetting("response-cache-ttl", "how long responses are served from the cache", func(c *Config) *Duration { return &c.ResponseCache.TTL }),
+	stringSetting("response-cache-dir", "directory keeping cached responses across restarts, unencrypted (off by default)", func(c *Config) *string { return &c.ResponseCache.Dir }),
+	intSetting("response-cache-disk-size", "number of responses kept in the response cache directory", func(c *Config) *int { return &c.ResponseCache.DiskSize }),
+	boolSetting("log-expressions", "log expression text (its hash is always logged)", func(c *Config) *bool { return &c.Log.Expressions }),
+	boolSetting("log-resources", "log submitted resources (may contain patient data)", func(c *Config) *bool { return &c.Log.Resources }),
+	durationSetting("read-timeout", "maximum duration for reading an entire request", func(c *Config) *Duration { return &c.Server.ReadTimeout }),
+	durationSetting("read-header-timeout", "maximum duration for reading request headers", func(c *Config) *Duration { return &c.Server.ReadHeaderTimeout }),
+	durationSetting("write-timeout", "maximum duration before timing out writes of the response", func(c *Config) *Duration { return &c.Server.WriteTimeout }),
+	durationSetting("idle-timeout", "maximum time to wait for the next request on keep-alive connections", func(c *Config) *Duration { return &c.Server.IdleTimeout }),
+	durationSetting("shutdown-timeout", "maximum time to drain in-flight requests on SIGTERM/SIGINT", func(c *Config) *Duration { return &c.Server.ShutdownTimeout }),
+	intSetting("max-header-bytes", "maximum size of request headers in bytes", func(c *Config) *int { return &c.Server.MaxHeaderBytes }),
+	int64Setting("max-body-bytes", "maximum size of request bodies in bytes (0 for no limit)", func(c *Config) *int64 { return &c.Server.MaxBodyBytes }),
+	boolSetting("http2", "enable HTTP/2", func(c *Config) *bool { return &c.Server.HTTP2 }),
+	boolSetting("compression", "compress responses with gzip or deflate as accepted by the client", func(c *Config) *bool { return &c.Compression.Enabled }),
+	intSetting("compression-min-size", "minimum response size in bytes to compress", func(c *Config) *int { return &c.Compression.MinSize }),
+	intSetting("compression-level", "compression level from 1 (fastest) to 9 (smallest), -1 for the default", func(c *Config) *int { return &c.Compression.Level }),
+	listSetting("cors-origins", `comma-separated allowed origins, "*" or patterns like https://*.example.org`, func(c *Config) *[]string { return &c.CORS.AllowedOrigins }),
+	listSetting("cors-headers", "comma-separated allowed request headers", func(c *Config) *[]string { return &c.CORS.AllowedHeaders }),
+	listSetting("cors-methods", "comma-separated allowed methods", func(c *Config) *[]string { return &c.CORS.AllowedMethods }),
+	boolSetting("cors-credentials", "allow credentialed cross-origin requests", func(c *Config) *bool { return &c.CORS.AllowCredentials }),
+	intSetting("cors-max-age", "seconds browsers may cache preflight responses", func(c *Config) *int { return &c.CORS.MaxAge }),
+	stringSetting("tls-cert", "PEM certificate (chain) file, enables HTTPS; reloaded when changed", func(c *Config) *string { return &c.TLS.Cert }),
+	stringSetting("tls-key", "PEM private key file of the certificate; reloaded when changed", func(c *Config) *string { return &c.TLS.Key }),
+	stringSetting("tls-client-ca", "PEM file of CAs to verify client certificates against (mutual TLS)", func(c *Config) *string { return &c.TLS.ClientCA }),
+	stringSetting("tls-client-auth", `client certificate verification with tls-client-ca: "require" (default), "optional" or "none"`, func(c *Config) *string { return &c.TLS.ClientAuth }),
+	apiKeysSetting("auth-api-keys", "comma-separated name=key API keys (X-API-Key or Bearer)", func(c *Config) *[]APIKey { return &c.Auth.Keys }),
+	stringSetting("auth-hmac-secret", "shared secret verifying HS256/HS384/HS512 bearer tokens", func(c *Config) *string { return (*string)(&c.Auth.HMACSecret) }),
+	stringSetting("auth-jwks", "JSON Web Key Set file verifying RS*, PS* and ES* bearer tokens", func(c *Config) *string { return &c.Auth.JWKS }),
+	stringSetting("auth-issuer", "required iss claim of bearer tokens", func(c *Config) *string { return &c.Auth.Issuer }),
+	stringSetting("auth-audience", "required aud claim of bearer tokens", func(c *Config) *string { return &c.Auth.Audience }),
+	floatSetting("rate-limit", "requests per second per client address or principal (0 for no limit)", func(c *Config) *float64 { return &c.Throttle.PerClient.Rate }),
+	intSetting("rate-burst", "request burst per client address or principal", func(c *Config) *int { return &c.Throttle.PerClient.Burst }),
+	stringSetting("client-ip-header", "header with the client address set by a trusted proxy, e.g. Fly-Client-IP", func(c *Config) *string { return &c.Throttle.ClientIPHeader }),
+	intSetting("max-concurrent", "maximum concurrent evaluations (0 for no limit)", func(c *Config) *int { return &c.Throttle.MaxConcurrent }),
+	intSetting("max-queue", "evaluations waiting for a slot before further ones get 429", func(c *Config) *int { return &c.Throttle.MaxQueue }),
+	durationSetting("queue-timeout", "maximum time an evaluation waits for a slot", func(c *Config) *Duration { return &c.Throttle.QueueTimeout }),
+	stringSetting("otlp-endpoint", "OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces; enables tracing", func(c *Config) *string { return &c.Tracing.Endpoint }),
+	stringSetting("trace-service-name", "service.name reported in traces", func(c *Config) *string { return &c.Tracing.ServiceName }),
+	floatSetting("trace-sample-ratio", "fraction of requests traced unless decided by a traceparent header", func(c *Config) *float64 { return &c.Tracing.SampleRatio }),
+	durationSetting("trace-export-interval", "how often spans are exported", func(c *Config) *Duration { return &c.Tracing.ExportInterval }),
+}
+
+// LoadConfig registers a flag per setting (plus -config and the mode flags) on fs, parses args and
+// returns the layered configuration. The file is given by -config or FHIRPATH_LAB_CONFIG, its
+// format is chosen by extension (.yaml/.yml, .toml, .json).
+func LoadConfig(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	defaults := DefaultConfig()
+	file, _ := lookupEnv(envPrefix + "CONFIG")
+	fs.StringVar(&file, "config", file, "YAML, TOML or JSON configuration file; env "+envPrefix+"CONFIG")
+	var modes []string
+	for _, mode := range []struct{ name, usage string }{
+		{ModePrintConfig, "print the effective configuration as JSON and exit"},
+		{ModeCheckConfig, "validate the configuration, load the store, keys and certificates, and exit"},
+	} {
+		fs.BoolFunc(mode.name, mode.usage, func(v string) error {
+			if on, err := strconv.ParseBool(v); err != nil || on {
+				modes = append(modes, mode.name)
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Flags are applied last, their values are collected while parsing
+	type flagValue struct {
+		s     setting
+		value string
+	}
+	var flagged []flagValue
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s; env %s (default %s)", s.usage, envName(s.name), s.get(&defaults))
+		collect := func(v string) error {
+			flagged = append(flagged, flagValue{s, v})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.name, usage, collect)
+		} else {
+			fs.Func(s.name, usage, collect)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if len(modes) > 1 {
+		return Config{}, fmt.Errorf("-%s can not be combined with -%s", modes[0], modes[1])
+	}
+
+	config := defaults
+	if len(modes) == 1 {
+		config.Mode = modes[0]
+	}
+	if file != "" {
+		if err := loadConfigFile(file, &config); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if port, ok := lookupEnv("PORT"); ok && strings.TrimSpace(port) != "" {
+		config.Addr = portAddr(strings.TrimSpace(port))
+	}
+	for _, s := range settings {
+		if v, ok := lookupEnv(envName(s.name)); ok {
+			if err := s.set(&config, v); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", envName(s.name), err)
+			}
+		}
+	}
+	for _, f := range flagged {
+		if err := f.s.set(&config, f.value); err != nil {
+			return Config{}, fmt.Errorf("-%s: %w", f.s.name, err)
+		}
+	}
+
+	return config, config.Validate()
+}
+
+// Validate reports all invalid settings.
+func (c Config) Validate() error {
+	var errs []error
+	if strings.TrimSpace(c.Addr) == "" {
+		errs = append(errs, errors.New("addr must not be empty"))
+	}
+	if c.Store != "" {
+		if fi, err := os.Stat(c.Store); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("store %q is not a directory", c.Store))
+		}
+	}
+	if c.ParseCache < 0 {
+		errs = append(errs, errors.New("parseCache must not be negative"))
+	}
+	if c.ParseCacheBytes < 0 {
+		errs = append(errs, errors.New("parseCacheBytes must not be negative"))
+	}
+	if !validEchoResource(c.EchoResource) {
+		errs = append(errs, fmt.Errorf("echoResource %q must be %q, %q or %q", c.EchoResource, EchoResourceFull, EchoResourceHash, EchoResourceOmit))
+	}
+	errs = append(errs, c.ResponseCache.validate()...)
+	for name, d := range map[string]Duration{
+		"readTimeout":       c.Server.ReadTimeout,
+		"readHeaderTimeout": c.Server.ReadHeaderTimeout,
+		"writeTimeout":      c.Server.WriteTimeout,
+		"idleTimeout":       c.Server.IdleTimeout,
+		"shutdownTimeout":   c.Server.ShutdownTimeout,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("server.%s must not be negative", name))
+		}
+	}
+	if c.Server.MaxHeaderBytes <= 0 {
+		errs = append(errs, errors.New("server.maxHeaderBytes must be positive"))
+	}
+	if c.Server.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("server.maxBodyBytes must not be negative"))
+	}
+	errs = append(errs, c.Compression.validate()...)
+	for _, o := range c.CORS.AllowedOrigins {
+		if o == "*" {
+			if c.CORS.AllowCredentials {
+				errs = append(errs, errors.New(`cors.allowedOrigins "*" can not be combined with cors.allowCredentials, list the origins instead`))
+			}
+			continue
+		}
+		if u, err := url.Parse(strings.Replace(o, "://*.", "://", 1)); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("cors origin %q must be \"*\" or scheme://host[:port]", o))
+		}
+	}
+	if len(c.CORS.AllowedMethods) == 0 {
+		errs = append(errs, errors.New("cors.allowedMethods must not be empty"))
+	}
+	if c.CORS.MaxAge < 0 {
+		errs = append(errs, errors.New("cors.maxAge must not be negative"))
+	}
+	errs = append(errs, c.TLS.validate()...)
+	errs = append(errs, c.Auth.validate()...)
+	errs = append(errs, c.Throttle.validate()...)
+	errs = append(errs, c.Tracing.validate()...)
+	return errors.Join(errs...)
+}
+
+// loadConfigFile decodes a configuration file over config. YAML and TOML are converted to JSON
+// first, so all formats share the JSON field names and unknown fields are rejected alike.
+func loadConfigFile(file string, config *Config) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		var doc map[string]any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	case ".toml":
+		var doc map[string]any
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	case ".json":
+	default:
+		return fmt.Errorf("%s: unsupported configuration format, use .yaml, .toml or .json", file)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// portAddr turns a PORT value into a listen address.
+func portAddr(port string) string {
+	if strings.Contains(port, ":") {
+		return port
+	}
+	return ":" + port
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Duration is a time.Duration written as a Go duration string (e.g. "30s") in configuration files.
+// Plain numbers are read as seconds.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+		return nil
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	return fmt.Errorf("invalid duration %s", b)
+}
+
+func stringSetting(name, usage string, field func(*Config) *string) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error { *field(c) = v; return nil },
+		get: func(c *Config) string { return strconv.Quote(*field(c)) },
+	}
+}
+
+func intSetting(name, usage string, field func(*Config) *int) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			*field(c) = n
+			return err
+		},
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func int64Setting(name, usage string, field func(*Config) *int64) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			*field(c) = n
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+	}
+}
+
+func floatSetting(name, usage string, field func(*Config) *float64) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error {
+			f, err := strconv.ParseFloat(v, 64)
+			*field(c) = f
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+	}
+}
+
+func boolSetting(name, usage string, field func(*Config) *bool) setting {
+	return setting{name: name, usage: usage, isBool: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			*field(c) = b
+			return err
+		},
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+	}
+}
+
+func durationSetting(name, usage string, field func(*Config) *Duration) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			*field(c) = Duration(d)
+			return err
+		},
+		get: func(c *Config) string { return field(c).String() },
+	}
+}
+
+func listSetting(name, usage string, field func(*Config) *[]string) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error { *field(c) = splitList(v); return nil },
+		get: func(c *Config) string { return strconv.Quote(strings.Join(*field(c), ",")) },
+	}
+}
+
+// apiKeysSetting reads API keys as comma-separated name=key pairs, replacing those of the file.
+func apiKeysSetting(name, usage string, field func(*Config) *[]APIKey) setting {
+	return setting{name: name, usage: usage,
+		set: func(c *Config, v string) error {
+			var keys []APIKey
+			for _, item := range splitList(v) {
+				name, key, ok := strings.Cut(item, "=")
+				if !ok {
+					// Don't echo the item, it is likely a key
+					return errors.New("API keys must be given as name=key")
+				}
+				keys = append(keys, APIKey{Name: strings.TrimSpace(name), Key: Secret(strings.TrimSpace(key))})
+			}
+			*field(c) = keys
+			return nil
+		},
+		get: func(c *Config) string { return strconv.Quote("") },
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
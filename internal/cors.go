@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig is the cross-origin policy of the server.
+type CORSConfig struct {
+	// AllowedOrigins lists allowed origins. "*" allows any origin, a "*." host prefix
+	// (e.g. "https://*.example.org") allows any subdomain with the same scheme and port.
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	AllowedMethods   []string `json:"allowedMethods"`
+	AllowCredentials bool     `json:"allowCredentials"`
+	// MaxAge is how long, in seconds, browsers may cache preflight responses.
+	MaxAge int `json:"maxAge"`
+}
+
+// DefaultCORSConfig allows the public fhirpath-lab deployments and a local development server.
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: []string{
+			"https://fhirpath-lab.com",
+			"https://dev.fhirpath-lab.com",
+			"https://hackweek.fhirpath-lab.com",
+			"http://localhost:3000",
+		},
+		AllowedHeaders: []string{"Content-Type", "Accept", "X-Request-ID", "Authorization", "X-API-Key"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodOptions},
+		MaxAge:         600,
+	}
+}
+
+// CORS writes the CORS headers of config for allowed origins and answers OPTIONS preflight requests.
+func CORS(config CORSConfig) func(http.Handler) http.Handler {
+	anyOrigin := false
+	for _, o := range config.AllowedOrigins {
+		anyOrigin = anyOrigin || o == "*"
+	}
+	headers := strings.Join(config.AllowedHeaders, ", ")
+	methods := strings.Join(config.AllowedMethods, ", ")
+	maxAge := strconv.Itoa(config.MaxAge)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if !anyOrigin || config.AllowCredentials {
+				w.Header().Add("Vary", "Origin")
+			}
+			if origin != "" && originAllowed(config.AllowedOrigins, origin) {
+				h := w.Header()
+				if anyOrigin && !config.AllowCredentials {
+					h.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					// Credentialed requests require the origin itself
+					h.Set("Access-Control-Allow-Origin", origin)
+				}
+				if config.AllowCredentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+				h.Set("Access-Control-Expose-Headers", "X-Request-ID, ETag, X-Cache")
+				if r.Method == http.MethodOptions {
+					h.Set("Access-Control-Allow-Headers", headers)
+					h.Set("Access-Control-Allow-Methods", methods)
+					if config.MaxAge > 0 {
+						h.Set("Access-Control-Max-Age", maxAge)
+					}
+				}
+			}
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// originAllowed matches an Origin header against the allowed origins and patterns.
+func originAllowed(allowed []string, origin string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+		if strings.Contains(a, "://*.") && matchOriginPattern(a, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOriginPattern(pattern, origin string) bool {
+	p, err := url.Parse(strings.Replace(pattern, "://*.", "://wildcard.", 1))
+	if err != nil {
+		return false
+	}
+	o, err := url.Parse(origin)
+	if err != nil || o.Host == "" {
+		return false
+	}
+	suffix := "." + strings.TrimPrefix(strings.ToLower(p.Hostname()), "wildcard.")
+	host := strings.ToLower(o.Hostname())
+	return strings.EqualFold(p.Scheme, o.Scheme) &&
+		p.Port() == o.Port() &&
+		strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+}
@@ -0,0 +1,554 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// releaseDetection is the outcome of detecting the FHIR release of a $fhirpath-auto request.
+type releaseDetection struct {
+	release string
+	// params are the request Parameters decoded in the detected release.
+	params fhirpath.Element
+	// warnings lists elements unknown in the detected release, which were dropped from the resource.
+	warnings []string
+	// err is why no release could be detected, in which case the body is decoded as R4 as usual.
+	err error
+}
+
+// releaseOrder is the order releases are tried in when the resource doesn't state its version.
+var releaseOrder = []string{"R4", "R4B", "R5"}
+
+var jsonDecoders = map[string]func(string) (model.Resource, error){
+	"R4":  decodeResourceFromJSON[model.R4],
+	"R4B": decodeResourceFromJSON[model.R4B],
+	"R5":  decodeResourceFromJSON[model.R5],
+}
+
+var xmlDecoders = map[string]func(string) (model.Resource, error){
+	"R4":  decodeResourceFromXML[model.R4],
+	"R4B": decodeResourceFromXML[model.R4B],
+	"R5":  decodeResourceFromXML[model.R5],
+}
+
+// invalidField matches the decoder error for elements not defined in a release.
+var invalidField = regexp.MustCompile(`invalid field: (\S+) in (\S+)`)
+
+// maxFitDecodes and maxFitBytes bound the decoding attempts to fit a resource into the candidate
+// releases, including those locating unknown elements, by count and by the bytes decoded in total.
+// The first attempt per release is always made, so large resources are only decoded strictly.
+const (
+	maxFitDecodes = 16
+	maxFitBytes   = 4 << 20
+)
+
+// probeField replaces an element to find out the type of the object holding it.
+const probeField = "fhirpathLabProbe"
+
+// releaseForVersion maps a FHIR version (e.g. "4.0.1" or the fhirVersion mime parameter) to a release.
+func releaseForVersion(version string) (string, bool) {
+	switch {
+	case strings.HasPrefix(version, "4.0"):
+		return "R4", true
+	case strings.HasPrefix(version, "4.3"):
+		return "R4B", true
+	case strings.HasPrefix(version, "5.0"):
+		return "R5", true
+	}
+	return "", false
+}
+
+// detectParameters decodes a Parameters body in the release that fits its resource best.
+//
+// An explicit version (fhirVersion mime parameter or the resource's own fhirVersion element) is used as is.
+// Otherwise the first release the resource decodes in without errors wins. If there is none,
+// elements unknown to a release are dropped and reported, and the release with the fewest unknown
+// elements is chosen.
+func detectParameters(data []byte, format, fhirVersion string) (releaseDetection, error) {
+	if fhirFormat(format) == mimeFHIRXML {
+		return detectParametersXML(data, fhirVersion)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return releaseDetection{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	// Locate the resource, either inline or as json-value extension
+	var resource map[string]any
+	var setResource func(map[string]any) error
+	params, _ := doc["parameter"].([]any)
+	for _, p := range params {
+		pm, ok := p.(map[string]any)
+		if !ok || pm["name"] != "resource" {
+			continue
+		}
+		if r, ok := pm["resource"].(map[string]any); ok {
+			resource = r
+			setResource = func(r map[string]any) error {
+				pm["resource"] = r
+				return nil
+			}
+		}
+		exts, _ := pm["extension"].([]any)
+		for _, e := range exts {
+			em, ok := e.(map[string]any)
+			if !ok || em["url"] != "http://fhir.forms-lab.com/StructureDefinition/json-value" {
+				continue
+			}
+			s, ok := em["valueString"].(string)
+			if !ok {
+				continue
+			}
+			dec := json.NewDecoder(strings.NewReader(s))
+			dec.UseNumber()
+			if err := dec.Decode(&resource); err != nil {
+				return releaseDetection{}, fmt.Errorf("invalid json-value resource: %w", err)
+			}
+			setResource = func(r map[string]any) error {
+				b, err := json.Marshal(r)
+				em["valueString"] = string(b)
+				return err
+			}
+		}
+	}
+
+	candidates := releaseOrder
+	if release, ok := releaseForVersion(fhirVersion); ok {
+		candidates = []string{release}
+	} else if v, ok := resource["fhirVersion"].(string); ok {
+		if release, ok := releaseForVersion(v); ok {
+			candidates = []string{release}
+		}
+	}
+
+	release := candidates[0]
+	var warnings []string
+	if resource != nil {
+		var fitted map[string]any
+		var err error
+		release, fitted, warnings, err = fitResource(resource, candidates)
+		if err != nil {
+			return releaseDetection{}, err
+		}
+		if err := setResource(fitted); err != nil {
+			return releaseDetection{}, err
+		}
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return releaseDetection{}, err
+	}
+	res, err := jsonDecoders[release](string(body))
+	if err != nil {
+		return releaseDetection{}, err
+	}
+	if res.ResourceType() != "Parameters" {
+		return releaseDetection{}, fmt.Errorf("expected Parameters, got %s", res.ResourceType())
+	}
+	return releaseDetection{release: release, params: res.(fhirpath.Element), warnings: warnings}, nil
+}
+
+// fitResource picks the release from candidates that the resource decodes in with the fewest dropped elements.
+func fitResource(resource map[string]any, candidates []string) (string, map[string]any, []string, error) {
+	bestRelease, bestResource, bestDropped := "", map[string]any(nil), []string(nil)
+	var firstErr error
+	budget := &fitBudget{}
+	for _, release := range candidates {
+		fitted, dropped, err := fitResourceRelease(resource, release, budget)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", release, err)
+			}
+			continue
+		}
+		if len(dropped) == 0 {
+			return release, fitted, nil, nil
+		}
+		if bestRelease == "" || len(dropped) < len(bestDropped) {
+			bestRelease, bestResource, bestDropped = release, fitted, dropped
+		}
+	}
+	if bestRelease == "" {
+		return "", nil, nil, fmt.Errorf("unable to determine FHIR release: %w", firstErr)
+	}
+
+	return bestRelease, bestResource, unknownElementWarnings(bestDropped, bestRelease), nil
+}
+
+// unknownElementWarnings reports elements unknown in a release, given as "'name' (location)".
+func unknownElementWarnings(unknown []string, release string) []string {
+	warnings := make([]string, 0, len(unknown))
+	for _, u := range unknown {
+		warnings = append(warnings, fmt.Sprintf("element %s is unknown in %s and was ignored", u, release))
+	}
+	return warnings
+}
+
+// fitResourceRelease decodes the resource in the given release, dropping elements the release doesn't define.
+func fitResourceRelease(resource map[string]any, release string, budget *fitBudget) (map[string]any, []string, error) {
+	f := resourceFitter{release: release, budget: budget}
+	current := resource
+	var dropped []string
+	for {
+		err := f.decode(current)
+		if err == nil {
+			return current, dropped, nil
+		}
+		m := invalidField.FindStringSubmatch(err.Error())
+		if m == nil {
+			return nil, nil, err
+		}
+		if budget.exhausted() {
+			return nil, nil, fmt.Errorf("too many unknown elements")
+		}
+		field, typ := m[1], m[2]
+		name := strings.TrimPrefix(field, "_")
+		if isResourceType(typ) {
+			// The element is unknown in every resource of this type
+			current = dropResourceElement(current, name, typ).(map[string]any)
+		} else {
+			path, err := f.locate(current, field, typ)
+			if err != nil {
+				return nil, nil, err
+			}
+			current = dropElementAt(current, path, name).(map[string]any)
+		}
+		dropped = append(dropped, fmt.Sprintf("'%s' (%s)", name, typ))
+	}
+}
+
+// fitBudget counts the decoding attempts of a detection, see maxFitDecodes.
+type fitBudget struct {
+	decodes int
+	bytes   int
+}
+
+func (b *fitBudget) exhausted() bool {
+	return b.decodes >= maxFitDecodes || b.bytes >= maxFitBytes
+}
+
+// resourceFitter decodes resources in a release, counting the attempts.
+type resourceFitter struct {
+	release string
+	budget  *fitBudget
+}
+
+func (f *resourceFitter) decode(resource map[string]any) error {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	f.budget.decodes++
+	f.budget.bytes += len(data)
+	_, err = jsonDecoders[f.release](string(data))
+	return err
+}
+
+// locate finds the JSON path of the object whose field the decoder reported as unknown in typ.
+//
+// JSON does not carry the types of nested elements and the field may be valid elsewhere, so the
+// objects holding it are probed in the order they are encoded, which is the order the decoder
+// reads them in: the first one the decoder reports as typ when the field is renamed is the one
+// that failed.
+func (f *resourceFitter) locate(resource map[string]any, field, typ string) ([]any, error) {
+	for _, path := range objectsWithField(resource, field, nil) {
+		if f.budget.exhausted() {
+			break
+		}
+		err := f.decode(renameFieldAt(resource, path, field, probeField).(map[string]any))
+		m := invalidField.FindStringSubmatch(fmt.Sprint(err))
+		if m == nil || m[1] != probeField {
+			// The field failed before this object was reached
+			break
+		}
+		if m[2] == typ {
+			return path, nil
+		}
+	}
+	return nil, fmt.Errorf("element '%s' (%s) is unknown in %s and could not be located", strings.TrimPrefix(field, "_"), typ, f.release)
+}
+
+// objectsWithField returns the paths (object keys and array indexes) of all objects in v holding
+// field, in the order json.Marshal encodes them.
+func objectsWithField(v any, field string, path []any) [][]any {
+	var paths [][]any
+	switch t := v.(type) {
+	case map[string]any:
+		for _, k := range slices.Sorted(maps.Keys(t)) {
+			if k == field {
+				paths = append(paths, slices.Clone(path))
+			}
+			paths = append(paths, objectsWithField(t[k], field, append(path, k))...)
+		}
+	case []any:
+		for i, child := range t {
+			paths = append(paths, objectsWithField(child, field, append(path, i))...)
+		}
+	}
+	return paths
+}
+
+// renameFieldAt returns a copy of v with field of the object at path renamed to name.
+func renameFieldAt(v any, path []any, field, name string) any {
+	return updateAt(v, path, func(obj map[string]any) {
+		obj[name] = obj[field]
+		delete(obj, field)
+	})
+}
+
+// dropElementAt returns a copy of v with the element (and its primitive extension sibling) removed
+// from the object at path.
+func dropElementAt(v any, path []any, name string) any {
+	return updateAt(v, path, func(obj map[string]any) {
+		delete(obj, name)
+		delete(obj, "_"+name)
+	})
+}
+
+// updateAt returns a copy of v with update applied to a copy of the object at path. Only the
+// objects and arrays along the path are copied.
+func updateAt(v any, path []any, update func(map[string]any)) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := maps.Clone(t)
+		if len(path) == 0 {
+			update(out)
+		} else if k, ok := path[0].(string); ok {
+			out[k] = updateAt(t[k], path[1:], update)
+		}
+		return out
+	case []any:
+		out := slices.Clone(t)
+		if len(path) > 0 {
+			if i, ok := path[0].(int); ok {
+				out[i] = updateAt(t[i], path[1:], update)
+			}
+		}
+		return out
+	}
+	return v
+}
+
+// dropResourceElement returns a copy of v with the element (and its primitive extension sibling)
+// removed from all resources of type typ.
+func dropResourceElement(v any, name, typ string) any {
+	switch t := v.(type) {
+	case map[string]any:
+		rt, _ := t["resourceType"].(string)
+		out := make(map[string]any, len(t))
+		for k, child := range t {
+			if rt == typ && (k == name || k == "_"+name) {
+				continue
+			}
+			out[k] = dropResourceElement(child, name, typ)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, child := range t {
+			out[i] = dropResourceElement(child, name, typ)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// isResourceType reports whether a type name reported by the decoder denotes a resource in any release.
+func isResourceType(typ string) bool {
+	for _, decode := range jsonDecoders {
+		if _, err := decode(`{"resourceType":"` + typ + `"}`); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// detectParametersXML decodes an XML Parameters body like detectParameters does JSON. Elements the
+// decoder fails on are cut from the body and reported.
+func detectParametersXML(data []byte, fhirVersion string) (releaseDetection, error) {
+	candidates := releaseOrder
+	if release, ok := releaseForVersion(fhirVersion); ok {
+		candidates = []string{release}
+	} else if release, ok := releaseForVersion(xmlResourceFHIRVersion(data)); ok {
+		candidates = []string{release}
+	}
+	var best releaseDetection
+	var bestDropped []string
+	var firstErr error
+	budget := &fitBudget{}
+	for _, release := range candidates {
+		res, dropped, err := fitXMLRelease(data, release, budget)
+		if err == nil && res.ResourceType() != "Parameters" {
+			err = fmt.Errorf("expected Parameters, got %s", res.ResourceType())
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", release, err)
+			}
+			continue
+		}
+		if len(dropped) == 0 {
+			return releaseDetection{release: release, params: res.(fhirpath.Element)}, nil
+		}
+		if best.release == "" || len(dropped) < len(bestDropped) {
+			best = releaseDetection{release: release, params: res.(fhirpath.Element)}
+			bestDropped = dropped
+		}
+	}
+	if best.release == "" {
+		return releaseDetection{}, fmt.Errorf("unable to determine FHIR release: %w", firstErr)
+	}
+	best.warnings = unknownElementWarnings(bestDropped, best.release)
+	return best, nil
+}
+
+// xmlResourceFHIRVersion returns the fhirVersion element of the resource parameter of an XML
+// Parameters body, given inline or as json-value extension, empty if there is none.
+func xmlResourceFHIRVersion(data []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var stack []string
+	jsonValue := false
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			switch {
+			// Parameters.parameter.resource.<Resource>.fhirVersion
+			case len(stack) == 5 && stack[2] == "resource" && t.Name.Local == "fhirVersion":
+				return xmlAttr(t, "value")
+			case len(stack) == 3 && t.Name.Local == "extension":
+				jsonValue = xmlAttr(t, "url") == "http://fhir.forms-lab.com/StructureDefinition/json-value"
+			case len(stack) == 4 && jsonValue && t.Name.Local == "valueString":
+				var resource struct {
+					FHIRVersion string `json:"fhirVersion"`
+				}
+				if json.Unmarshal([]byte(xmlAttr(t, "value")), &resource) == nil && resource.FHIRVersion != "" {
+					return resource.FHIRVersion
+				}
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// xmlAttr returns the value of the attribute name of an element, empty if it has none.
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// unconsumedElement matches the error of encoding/xml for an element the model decoder returned
+// from early, which it does at the end of the first unknown child.
+var unconsumedElement = regexp.MustCompile(`did not consume entire <(\S+)> element`)
+
+// fitXMLRelease decodes XML in the given release, cutting elements the release doesn't define.
+func fitXMLRelease(data []byte, release string, budget *fitBudget) (model.Resource, []string, error) {
+	var dropped []string
+	for {
+		budget.decodes++
+		budget.bytes += len(data)
+		res, err := xmlDecoders[release](string(data))
+		if err == nil {
+			return res, dropped, nil
+		}
+		var decodeErr *xmlDecodeError
+		if !errors.As(err, &decodeErr) {
+			return nil, nil, err
+		}
+		m := unconsumedElement.FindStringSubmatch(decodeErr.err.Error())
+		if m == nil {
+			return nil, nil, err
+		}
+		if budget.exhausted() {
+			return nil, nil, fmt.Errorf("too many unknown elements")
+		}
+		start, end, unknown, err := locateXMLElement(data, decodeErr.offset, m[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		data = slices.Concat(data[:start], data[end:])
+		dropped = append(dropped, unknown)
+	}
+}
+
+// locateXMLElement finds the unknown element the decoder stopped in at offset: the child of the
+// innermost element named parent that is open there. It returns the byte range of the unknown
+// element and describes it as "'name' (location)", the location being the path from the enclosing
+// resource.
+func locateXMLElement(data []byte, offset int64, parent string) (int64, int64, string, error) {
+	type openElement struct {
+		name  string
+		start int64
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var stack []openElement
+	unknown := -1
+	for {
+		start := d.InputOffset()
+		tok, err := d.Token()
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("unknown element in <%s> could not be located: %w", parent, err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, openElement{name: t.Name.Local, start: start})
+		case xml.EndElement:
+			if unknown < 0 && d.InputOffset() >= offset {
+				for i := len(stack) - 2; i >= 0; i-- {
+					if stack[i].name == parent {
+						unknown = i + 1
+						break
+					}
+				}
+				if unknown < 0 {
+					return 0, 0, "", fmt.Errorf("unknown element in <%s> could not be located", parent)
+				}
+			}
+			if len(stack)-1 == unknown {
+				location := stack[:unknown]
+				for i := len(location) - 1; i >= 0; i-- {
+					if isResourceElement(location[i].name) {
+						location = location[i:]
+						break
+					}
+				}
+				names := make([]string, len(location))
+				for i, e := range location {
+					names[i] = e.name
+				}
+				desc := fmt.Sprintf("'%s' (%s)", stack[unknown].name, strings.Join(names, "."))
+				return stack[unknown].start, d.InputOffset(), desc, nil
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// isResourceElement reports whether an XML element name denotes a resource, which unlike the
+// names of elements start with an upper case letter.
+func isResourceElement(name string) bool {
+	return name != "" && name[0] >= 'A' && name[0] <= 'Z'
+}
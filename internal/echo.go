@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"strings"
+)
+
+// Modes of echoing the submitted resource in the parameters part of responses.
+const (
+	// EchoResourceFull echoes the resource as json-value, as the specification describes.
+	EchoResourceFull = "full"
+	// EchoResourceHash echoes only a hash of the resource.
+	EchoResourceHash = "hash"
+	// EchoResourceOmit leaves the resource out.
+	EchoResourceOmit = "omit"
+)
+
+// resourceHashExtensionURL carries the hash of the submitted resource when it is not echoed in full.
+const resourceHashExtensionURL = "http://fhir.forms-lab.com/StructureDefinition/resource-hash"
+
+// validEchoResource reports whether mode is one of the echo modes.
+func validEchoResource(mode string) bool {
+	switch mode {
+	case EchoResourceFull, EchoResourceHash, EchoResourceOmit:
+		return true
+	}
+	return false
+}
+
+// parseEchoResource reads the echoResource parameter: a boolean (false omits the resource) or one
+// of the echo modes as string or code.
+func parseEchoResource(value fhirpath.Element) (string, error) {
+	if b, ok, err := value.ToBoolean(false); err == nil && ok {
+		if b {
+			return EchoResourceFull, nil
+		}
+		return EchoResourceOmit, nil
+	}
+	s, ok, err := value.ToString(false)
+	if err != nil || !ok {
+		return "", fmt.Errorf("invalid 'echoResource' parameter")
+	}
+	if mode := strings.ToLower(string(s)); validEchoResource(mode) {
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid 'echoResource' parameter %q, use a boolean or %s, %s or %s",
+		s, EchoResourceFull, EchoResourceHash, EchoResourceOmit)
+}
+
+// echoMode returns how the resource is echoed: as requested, else the server default, else in full.
+func (inputs evalInputs) echoMode() string {
+	switch {
+	case inputs.echoResource != "":
+		return inputs.echoResource
+	case inputs.defaultEcho != "":
+		return inputs.defaultEcho
+	}
+	return EchoResourceFull
+}
+
+// resourceHash identifies a resource by the SHA-256 of its FHIR JSON encoding, e.g. "sha256:9f86d0...".
+func resourceHash(resource model.Resource) (string, error) {
+	s, err := encodeFHIRJSON(resource)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
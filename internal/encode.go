@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// encodeFHIRJSON encodes a value with the FHIR JSON encoder of its model type.
+//
+// Unlike json.Marshal, markup (e.g. narrative xhtml) is not HTML-escaped. Primitives carry their
+// id and extensions in the "_name" sibling of their parent, so a primitive encoded on its own that
+// has either is written the same way, as an object holding "value" and "_value".
+func encodeFHIRJSON(v any) (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+
+	if meta, ok := primitiveElement(v); ok && (meta.Id != nil || meta.Extension != nil) {
+		var obj struct {
+			Value any           `json:"value,omitempty"`
+			Meta  primitiveMeta `json:"_value"`
+		}
+		if p, ok := v.(interface{ HasValue() bool }); ok && p.HasValue() {
+			obj.Value = v
+		}
+		obj.Meta = meta
+		v = obj
+	}
+
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(b.Bytes(), []byte("\n"))), nil
+}
+
+// primitiveMeta is the id and extensions of a primitive, i.e. its "_name" object in FHIR JSON.
+type primitiveMeta struct {
+	Id        *string `json:"id,omitempty"`
+	Extension any     `json:"extension,omitempty"`
+}
+
+func primitiveMetaOf[E any](id *string, extension []E) primitiveMeta {
+	meta := primitiveMeta{Id: id}
+	if len(extension) > 0 {
+		meta.Extension = extension
+	}
+	return meta
+}
+
+// primitiveElement returns the id and extensions of a FHIR primitive of any release.
+func primitiveElement(v any) (primitiveMeta, bool) {
+	for _, element := range []func(any) (primitiveMeta, bool){primitiveElementR4, primitiveElementR4B, primitiveElementR5} {
+		if meta, ok := element(v); ok {
+			return meta, true
+		}
+	}
+	return primitiveMeta{}, false
+}
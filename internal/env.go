@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"regexp"
+)
+
+// standardEnv holds the environment variables defined by FHIRPath and the FHIR specification
+// that map to fixed code system URLs.
+var standardEnv = map[string]string{
+	"ucum":  "http://unitsofmeasure.org",
+	"sct":   "http://snomed.info/sct",
+	"loinc": "http://loinc.org",
+}
+
+// envShorthand matches the %`vs-[name]` and %`ext-[name]` URL shorthands.
+// The engine looks up delimited names including their quotes, so the whole token is captured.
+var envShorthand = regexp.MustCompile("%((`|')(vs|ext)-([^`']+)(`|'))")
+
+// scopedVariable matches references to %resource and %rootResource, which are bound per
+// context item to the resources enclosing it.
+var scopedVariable = regexp.MustCompile("%[`']?(resource|rootResource)\\b")
+
+// withStandardEnv binds the spec's standard environment variables, including any
+// %`vs-`/%`ext-` shorthands used by the given expressions.
+//
+// %context is bound per context item by the caller.
+func withStandardEnv(ctx context.Context, expressions ...string) context.Context {
+	for name, url := range standardEnv {
+		ctx = fhirpath.WithEnv(ctx, name, fhirpath.Collection{fhirpath.String(url)})
+	}
+
+	for _, expr := range expressions {
+		for _, m := range envShorthand.FindAllStringSubmatch(expr, -1) {
+			if m[2] != m[5] {
+				continue
+			}
+			var url string
+			switch m[3] {
+			case "vs":
+				url = "http://hl7.org/fhir/ValueSet/" + m[4]
+			case "ext":
+				url = "http://hl7.org/fhir/StructureDefinition/" + m[4]
+			}
+			ctx = fhirpath.WithEnv(ctx, m[1], fhirpath.Collection{fhirpath.String(url)})
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	mimeFHIRJSON = "application/fhir+json"
+	mimeFHIRXML  = "application/fhir+xml"
+)
+
+type fhirVersionKey struct{}
+
+// NegotiateFormat normalizes the Content-Type and Accept headers and the _format parameter to the
+// bare FHIR mime types, because rest.Server only recognizes exact values. This allows charset and
+// fhirVersion parameters, q-values and lists in Accept.
+//
+// Without a FHIR format in Accept or _format, the response is in the format of the request body,
+// as is the convention in FHIR REST. The fhirVersion parameter of the Content-Type is kept in the
+// request context for release detection.
+func NegotiateFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && params["fhirversion"] != "" {
+			ctx = context.WithValue(ctx, fhirVersionKey{}, params["fhirversion"])
+		}
+		r = r.Clone(ctx)
+
+		if f := fhirFormat(r.Header.Get("Content-Type")); f != "" {
+			r.Header.Set("Content-Type", f)
+		}
+		accepted := acceptedFormat(r.Header.Values("Accept"))
+		if accepted != "" {
+			r.Header.Set("Accept", accepted)
+		}
+
+		query := r.URL.Query()
+		format := fhirFormat(query.Get("_format"))
+		if v := query.Get("_format"); v != "" {
+			if format != "" && format != v {
+				query.Set("_format", format)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+
+		if accepted == "" && format == "" {
+			if f := r.Header.Get("Content-Type"); f == mimeFHIRJSON || f == mimeFHIRXML {
+				r.Header.Set("Accept", f)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fhirFormat maps a mime type (with optional parameters) or a _format shorthand to the FHIR mime type.
+func fhirFormat(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		mediaType = strings.ToLower(value)
+	}
+	switch mediaType {
+	case mimeFHIRJSON, "application/json", "text/json", "json":
+		return mimeFHIRJSON
+	case mimeFHIRXML, "application/xml", "text/xml", "xml":
+		return mimeFHIRXML
+	}
+	return ""
+}
+
+// acceptedFormat picks the FHIR format with the highest q-value from Accept headers.
+// Wildcards are ignored so the server default applies.
+func acceptedFormat(values []string) string {
+	type candidate struct {
+		format string
+		q      float64
+	}
+	var candidates []candidate
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			_, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+			q := 1.0
+			if err == nil {
+				if s, ok := params["q"]; ok {
+					if parsed, err := strconv.ParseFloat(s, 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+			if f := fhirFormat(item); f != "" && q > 0 {
+				candidates = append(candidates, candidate{format: f, q: q})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0].format
+}
+
+// requestFHIRVersion returns the fhirVersion mime parameter recorded by NegotiateFormat, if any.
+func requestFHIRVersion(ctx context.Context) string {
+	v, _ := ctx.Value(fhirVersionKey{}).(string)
+	return v
+}
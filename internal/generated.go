@@ -2,7 +2,6 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
 	"github.com/damedic/fhir-toolbox-go/model"
@@ -10,6 +9,7 @@ import (
 	"github.com/damedic/fhir-toolbox-go/model/gen/r4b"
 	"github.com/damedic/fhir-toolbox-go/model/gen/r5"
 	"github.com/damedic/fhir-toolbox-go/utils/ptr"
+	"time"
 )
 
 // buildR4Parameters builds R4 Parameters response
@@ -17,7 +17,8 @@ func buildR4Parameters[R model.Release](result evalResult, inputs evalInputs) r4
 	var release R
 	out := r4.Parameters{}
 
-	// Build result parameters
+	// Build result parameters, timing the whole response up to the timing part
+	start := time.Now()
 	for _, res := range result.results {
 		resultParam := r4.ParametersParameter{
 			Name: r4.String{Value: ptr.To("result")},
@@ -59,17 +60,30 @@ func buildR4Parameters[R model.Release](result evalResult, inputs evalInputs) r4
 		})
 	}
 
-	// Add resource parameter - use json-value extension to support cross-release resources
-	resourceJSON, err := json.Marshal(inputs.resource)
-	if err == nil {
-		resourceJSONStr := string(resourceJSON)
-		paramsPart.Part = append(paramsPart.Part, r4.ParametersParameter{
-			Name: r4.String{Value: ptr.To("resource")},
-			Extension: []r4.Extension{{
-				Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
-				Value: r4.String{Value: &resourceJSONStr},
-			}},
-		})
+	// Add resource parameter - use json-value extension to support cross-release resources,
+	// or only reference the resource by its hash if requested
+	switch inputs.echoMode() {
+	case EchoResourceFull:
+		resourceJSONStr, err := encodeFHIRJSON(inputs.resource)
+		if err == nil {
+			paramsPart.Part = append(paramsPart.Part, r4.ParametersParameter{
+				Name: r4.String{Value: ptr.To("resource")},
+				Extension: []r4.Extension{{
+					Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
+					Value: r4.String{Value: &resourceJSONStr},
+				}},
+			})
+		}
+	case EchoResourceHash:
+		if hash, err := resourceHash(inputs.resource); err == nil {
+			paramsPart.Part = append(paramsPart.Part, r4.ParametersParameter{
+				Name: r4.String{Value: ptr.To("resource")},
+				Extension: []r4.Extension{{
+					Url:   resourceHashExtensionURL,
+					Value: r4.String{Value: &hash},
+				}},
+			})
+		}
 	}
 
 	// Add variables if present
@@ -90,40 +104,189 @@ func buildR4Parameters[R model.Release](result evalResult, inputs evalInputs) r4
 		paramsPart.Part = append(paramsPart.Part, varsParam)
 	}
 
+	if inputs.detectedRelease != "" {
+		paramsPart.Part = append(paramsPart.Part, r4.ParametersParameter{
+			Name:  r4.String{Value: ptr.To("detectedRelease")},
+			Value: r4.String{Value: &inputs.detectedRelease},
+		})
+	}
+
+	// Add warnings if present (e.g. unknown elements, unresolvable references)
+	if warnings := append(append([]string(nil), inputs.warnings...), result.warnings...); len(warnings) > 0 {
+		warningsParam := r4.ParametersParameter{Name: r4.String{Value: ptr.To("warnings")}}
+		for _, w := range warnings {
+			warningsParam.Part = append(warningsParam.Part, r4.ParametersParameter{
+				Name:  r4.String{Value: ptr.To("warning")},
+				Value: r4.String{Value: ptr.To(w)},
+			})
+		}
+		paramsPart.Part = append(paramsPart.Part, warningsParam)
+	}
+
+	if inputs.timing {
+		paramsPart.Part = append(paramsPart.Part, timingPartR4(result, inputs, time.Since(start)))
+	}
+
 	out.Parameter = append(out.Parameter, paramsPart)
 	return out
 }
 
+// timingPartR4 reports the microseconds spent in each phase of the evaluation,
+// with one evaluate part per context item
+func timingPartR4(result evalResult, inputs evalInputs, serialize time.Duration) r4.ParametersParameter {
+	phase := func(name string, d time.Duration) r4.ParametersParameter {
+		return r4.ParametersParameter{
+			Name:  r4.String{Value: ptr.To(name)},
+			Value: microseconds[r4.Decimal](d),
+		}
+	}
+
+	timing := r4.ParametersParameter{
+		Name: r4.String{Value: ptr.To("timing")},
+		Part: []r4.ParametersParameter{
+			phase("decodeResource", inputs.decodeResource),
+			phase("parseExpression", result.timings.parseExpression),
+		},
+	}
+	if inputs.context != "" {
+		timing.Part = append(timing.Part,
+			phase("parseContext", result.timings.parseContext),
+			phase("evaluateContext", result.timings.evaluateContext))
+	}
+	for _, res := range result.results {
+		timing.Part = append(timing.Part, phase("evaluate", res.evaluation))
+	}
+	timing.Part = append(timing.Part, phase("serialize", serialize))
+	return timing
+}
+
 // makePartsR4 converts FHIRPath collection to R4 parameter parts
 func makePartsR4(values fhirpath.Collection) []r4.ParametersParameter {
 	var parts []r4.ParametersParameter
 
 	for _, v := range values {
 		tname := typeNameOf(v)
-
-		// Try to use value[x] first for primitive types
+		// The qualified type tells System-typed values from FHIR elements
+		qualifiedType := qualifiedTypeName(v)
+		typeExts := []r4.Extension{{
+			Url:   typeExtensionURL,
+			Value: r4.String{Value: &qualifiedType},
+		}}
+
+		// Try to use value[x] first for primitive types, System types map to the matching FHIR type
 		pv, ok := v.(r4.ParametersParameterValue)
+		if !ok {
+			pv, ok = systemParameterValueR4(v)
+		}
 		if ok {
-			parts = append(parts, r4.ParametersParameter{Name: r4.String{Value: &tname}, Value: pv})
+			parts = append(parts, r4.ParametersParameter{
+				Name:      r4.String{Value: &tname},
+				Extension: typeExts,
+				Value:     pv,
+			})
 			continue
 		}
 
 		// For everything else (resources, complex types, etc.), use json-value extension
-		jsonBytes, err := json.Marshal(v)
+		jsonStr, err := encodeFHIRJSON(v)
 		if err == nil {
-			jsonStr := string(jsonBytes)
 			parts = append(parts, r4.ParametersParameter{
 				Name: r4.String{Value: &tname},
-				Extension: []r4.Extension{{
-					Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
-					Value: r4.String{Value: &jsonStr},
-				}},
+				Extension: append([]r4.Extension{
+					{
+						Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
+						Value: r4.String{Value: &jsonStr},
+					},
+				}, typeExts...),
 			})
 		}
 	}
 	return parts
 }
 
+// primitiveElementR4 returns the id and extensions of a R4 primitive.
+func primitiveElementR4(v any) (primitiveMeta, bool) {
+	switch p := v.(type) {
+	case r4.Base64Binary:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Boolean:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Canonical:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Code:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Date:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.DateTime:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Decimal:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Id:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Instant:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Integer:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Markdown:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Oid:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.PositiveInt:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.String:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Time:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.UnsignedInt:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Uri:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Url:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4.Uuid:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	}
+	return primitiveMeta{}, false
+}
+
+// systemParameterValueR4 converts a System-typed value to the R4 value[x] it maps to,
+// keeping its lexical form and precision.
+func systemParameterValueR4(v fhirpath.Element) (r4.ParametersParameterValue, bool) {
+	sv, ok := systemValueOf(v)
+	if !ok {
+		return nil, false
+	}
+	switch sv.fhirType {
+	case "boolean":
+		return r4.Boolean{Value: &sv.boolean}, true
+	case "integer":
+		return r4.Integer{Value: &sv.integer}, true
+	case "integer64":
+		// integer64 was introduced in R5, the exact integral decimal is the closest type
+		return r4.Decimal{Value: sv.decimal.Value}, true
+	case "decimal":
+		return r4.Decimal{Value: sv.decimal.Value}, true
+	case "date":
+		return r4.Date{Value: &sv.lexical}, true
+	case "dateTime":
+		return r4.DateTime{Value: &sv.lexical}, true
+	case "time":
+		return r4.Time{Value: &sv.lexical}, true
+	case "Quantity":
+		q := r4.Quantity{Value: &r4.Decimal{Value: sv.decimal.Value}}
+		if sv.unit != "" {
+			q.Unit = &r4.String{Value: &sv.unit}
+		}
+		if sv.ucum {
+			q.System = &r4.Uri{Value: ptr.To("http://unitsofmeasure.org")}
+			q.Code = &r4.Code{Value: &sv.unit}
+		}
+		return q, true
+	default:
+		return r4.String{Value: &sv.lexical}, true
+	}
+}
+
 // opErrR4 creates R4 OperationOutcome for errors
 func opErrR4(severity, code, diagnostics string) r4.OperationOutcome {
 	return r4.OperationOutcome{Issue: []r4.OperationOutcomeIssue{{
@@ -144,7 +307,8 @@ func buildR4BParameters[R model.Release](result evalResult, inputs evalInputs) r
 	var release R
 	out := r4b.Parameters{}
 
-	// Build result parameters
+	// Build result parameters, timing the whole response up to the timing part
+	start := time.Now()
 	for _, res := range result.results {
 		resultParam := r4b.ParametersParameter{
 			Name: r4b.String{Value: ptr.To("result")},
@@ -186,17 +350,30 @@ func buildR4BParameters[R model.Release](result evalResult, inputs evalInputs) r
 		})
 	}
 
-	// Add resource parameter - use json-value extension to support cross-release resources
-	resourceJSON, err := json.Marshal(inputs.resource)
-	if err == nil {
-		resourceJSONStr := string(resourceJSON)
-		paramsPart.Part = append(paramsPart.Part, r4b.ParametersParameter{
-			Name: r4b.String{Value: ptr.To("resource")},
-			Extension: []r4b.Extension{{
-				Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
-				Value: r4b.String{Value: &resourceJSONStr},
-			}},
-		})
+	// Add resource parameter - use json-value extension to support cross-release resources,
+	// or only reference the resource by its hash if requested
+	switch inputs.echoMode() {
+	case EchoResourceFull:
+		resourceJSONStr, err := encodeFHIRJSON(inputs.resource)
+		if err == nil {
+			paramsPart.Part = append(paramsPart.Part, r4b.ParametersParameter{
+				Name: r4b.String{Value: ptr.To("resource")},
+				Extension: []r4b.Extension{{
+					Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
+					Value: r4b.String{Value: &resourceJSONStr},
+				}},
+			})
+		}
+	case EchoResourceHash:
+		if hash, err := resourceHash(inputs.resource); err == nil {
+			paramsPart.Part = append(paramsPart.Part, r4b.ParametersParameter{
+				Name: r4b.String{Value: ptr.To("resource")},
+				Extension: []r4b.Extension{{
+					Url:   resourceHashExtensionURL,
+					Value: r4b.String{Value: &hash},
+				}},
+			})
+		}
 	}
 
 	// Add variables if present
@@ -217,40 +394,189 @@ func buildR4BParameters[R model.Release](result evalResult, inputs evalInputs) r
 		paramsPart.Part = append(paramsPart.Part, varsParam)
 	}
 
+	if inputs.detectedRelease != "" {
+		paramsPart.Part = append(paramsPart.Part, r4b.ParametersParameter{
+			Name:  r4b.String{Value: ptr.To("detectedRelease")},
+			Value: r4b.String{Value: &inputs.detectedRelease},
+		})
+	}
+
+	// Add warnings if present (e.g. unknown elements, unresolvable references)
+	if warnings := append(append([]string(nil), inputs.warnings...), result.warnings...); len(warnings) > 0 {
+		warningsParam := r4b.ParametersParameter{Name: r4b.String{Value: ptr.To("warnings")}}
+		for _, w := range warnings {
+			warningsParam.Part = append(warningsParam.Part, r4b.ParametersParameter{
+				Name:  r4b.String{Value: ptr.To("warning")},
+				Value: r4b.String{Value: ptr.To(w)},
+			})
+		}
+		paramsPart.Part = append(paramsPart.Part, warningsParam)
+	}
+
+	if inputs.timing {
+		paramsPart.Part = append(paramsPart.Part, timingPartR4B(result, inputs, time.Since(start)))
+	}
+
 	out.Parameter = append(out.Parameter, paramsPart)
 	return out
 }
 
+// timingPartR4B reports the microseconds spent in each phase of the evaluation,
+// with one evaluate part per context item
+func timingPartR4B(result evalResult, inputs evalInputs, serialize time.Duration) r4b.ParametersParameter {
+	phase := func(name string, d time.Duration) r4b.ParametersParameter {
+		return r4b.ParametersParameter{
+			Name:  r4b.String{Value: ptr.To(name)},
+			Value: microseconds[r4b.Decimal](d),
+		}
+	}
+
+	timing := r4b.ParametersParameter{
+		Name: r4b.String{Value: ptr.To("timing")},
+		Part: []r4b.ParametersParameter{
+			phase("decodeResource", inputs.decodeResource),
+			phase("parseExpression", result.timings.parseExpression),
+		},
+	}
+	if inputs.context != "" {
+		timing.Part = append(timing.Part,
+			phase("parseContext", result.timings.parseContext),
+			phase("evaluateContext", result.timings.evaluateContext))
+	}
+	for _, res := range result.results {
+		timing.Part = append(timing.Part, phase("evaluate", res.evaluation))
+	}
+	timing.Part = append(timing.Part, phase("serialize", serialize))
+	return timing
+}
+
 // makePartsR4B converts FHIRPath collection to R4B parameter parts
 func makePartsR4B(values fhirpath.Collection) []r4b.ParametersParameter {
 	var parts []r4b.ParametersParameter
 
 	for _, v := range values {
 		tname := typeNameOf(v)
-
-		// Try to use value[x] first for primitive types
+		// The qualified type tells System-typed values from FHIR elements
+		qualifiedType := qualifiedTypeName(v)
+		typeExts := []r4b.Extension{{
+			Url:   typeExtensionURL,
+			Value: r4b.String{Value: &qualifiedType},
+		}}
+
+		// Try to use value[x] first for primitive types, System types map to the matching FHIR type
 		pv, ok := v.(r4b.ParametersParameterValue)
+		if !ok {
+			pv, ok = systemParameterValueR4B(v)
+		}
 		if ok {
-			parts = append(parts, r4b.ParametersParameter{Name: r4b.String{Value: &tname}, Value: pv})
+			parts = append(parts, r4b.ParametersParameter{
+				Name:      r4b.String{Value: &tname},
+				Extension: typeExts,
+				Value:     pv,
+			})
 			continue
 		}
 
 		// For everything else (resources, complex types, etc.), use json-value extension
-		jsonBytes, err := json.Marshal(v)
+		jsonStr, err := encodeFHIRJSON(v)
 		if err == nil {
-			jsonStr := string(jsonBytes)
 			parts = append(parts, r4b.ParametersParameter{
 				Name: r4b.String{Value: &tname},
-				Extension: []r4b.Extension{{
-					Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
-					Value: r4b.String{Value: &jsonStr},
-				}},
+				Extension: append([]r4b.Extension{
+					{
+						Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
+						Value: r4b.String{Value: &jsonStr},
+					},
+				}, typeExts...),
 			})
 		}
 	}
 	return parts
 }
 
+// primitiveElementR4B returns the id and extensions of a R4B primitive.
+func primitiveElementR4B(v any) (primitiveMeta, bool) {
+	switch p := v.(type) {
+	case r4b.Base64Binary:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Boolean:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Canonical:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Code:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Date:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.DateTime:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Decimal:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Id:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Instant:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Integer:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Markdown:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Oid:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.PositiveInt:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.String:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Time:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.UnsignedInt:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Uri:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Url:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r4b.Uuid:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	}
+	return primitiveMeta{}, false
+}
+
+// systemParameterValueR4B converts a System-typed value to the R4B value[x] it maps to,
+// keeping its lexical form and precision.
+func systemParameterValueR4B(v fhirpath.Element) (r4b.ParametersParameterValue, bool) {
+	sv, ok := systemValueOf(v)
+	if !ok {
+		return nil, false
+	}
+	switch sv.fhirType {
+	case "boolean":
+		return r4b.Boolean{Value: &sv.boolean}, true
+	case "integer":
+		return r4b.Integer{Value: &sv.integer}, true
+	case "integer64":
+		// integer64 was introduced in R5, the exact integral decimal is the closest type
+		return r4b.Decimal{Value: sv.decimal.Value}, true
+	case "decimal":
+		return r4b.Decimal{Value: sv.decimal.Value}, true
+	case "date":
+		return r4b.Date{Value: &sv.lexical}, true
+	case "dateTime":
+		return r4b.DateTime{Value: &sv.lexical}, true
+	case "time":
+		return r4b.Time{Value: &sv.lexical}, true
+	case "Quantity":
+		q := r4b.Quantity{Value: &r4b.Decimal{Value: sv.decimal.Value}}
+		if sv.unit != "" {
+			q.Unit = &r4b.String{Value: &sv.unit}
+		}
+		if sv.ucum {
+			q.System = &r4b.Uri{Value: ptr.To("http://unitsofmeasure.org")}
+			q.Code = &r4b.Code{Value: &sv.unit}
+		}
+		return q, true
+	default:
+		return r4b.String{Value: &sv.lexical}, true
+	}
+}
+
 // opErrR4B creates R4B OperationOutcome for errors
 func opErrR4B(severity, code, diagnostics string) r4b.OperationOutcome {
 	return r4b.OperationOutcome{Issue: []r4b.OperationOutcomeIssue{{
@@ -271,7 +597,8 @@ func buildR5Parameters[R model.Release](result evalResult, inputs evalInputs) r5
 	var release R
 	out := r5.Parameters{}
 
-	// Build result parameters
+	// Build result parameters, timing the whole response up to the timing part
+	start := time.Now()
 	for _, res := range result.results {
 		resultParam := r5.ParametersParameter{
 			Name: r5.String{Value: ptr.To("result")},
@@ -313,17 +640,30 @@ func buildR5Parameters[R model.Release](result evalResult, inputs evalInputs) r5
 		})
 	}
 
-	// Add resource parameter - use json-value extension to support cross-release resources
-	resourceJSON, err := json.Marshal(inputs.resource)
-	if err == nil {
-		resourceJSONStr := string(resourceJSON)
-		paramsPart.Part = append(paramsPart.Part, r5.ParametersParameter{
-			Name: r5.String{Value: ptr.To("resource")},
-			Extension: []r5.Extension{{
-				Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
-				Value: r5.String{Value: &resourceJSONStr},
-			}},
-		})
+	// Add resource parameter - use json-value extension to support cross-release resources,
+	// or only reference the resource by its hash if requested
+	switch inputs.echoMode() {
+	case EchoResourceFull:
+		resourceJSONStr, err := encodeFHIRJSON(inputs.resource)
+		if err == nil {
+			paramsPart.Part = append(paramsPart.Part, r5.ParametersParameter{
+				Name: r5.String{Value: ptr.To("resource")},
+				Extension: []r5.Extension{{
+					Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
+					Value: r5.String{Value: &resourceJSONStr},
+				}},
+			})
+		}
+	case EchoResourceHash:
+		if hash, err := resourceHash(inputs.resource); err == nil {
+			paramsPart.Part = append(paramsPart.Part, r5.ParametersParameter{
+				Name: r5.String{Value: ptr.To("resource")},
+				Extension: []r5.Extension{{
+					Url:   resourceHashExtensionURL,
+					Value: r5.String{Value: &hash},
+				}},
+			})
+		}
 	}
 
 	// Add variables if present
@@ -344,40 +684,190 @@ func buildR5Parameters[R model.Release](result evalResult, inputs evalInputs) r5
 		paramsPart.Part = append(paramsPart.Part, varsParam)
 	}
 
+	if inputs.detectedRelease != "" {
+		paramsPart.Part = append(paramsPart.Part, r5.ParametersParameter{
+			Name:  r5.String{Value: ptr.To("detectedRelease")},
+			Value: r5.String{Value: &inputs.detectedRelease},
+		})
+	}
+
+	// Add warnings if present (e.g. unknown elements, unresolvable references)
+	if warnings := append(append([]string(nil), inputs.warnings...), result.warnings...); len(warnings) > 0 {
+		warningsParam := r5.ParametersParameter{Name: r5.String{Value: ptr.To("warnings")}}
+		for _, w := range warnings {
+			warningsParam.Part = append(warningsParam.Part, r5.ParametersParameter{
+				Name:  r5.String{Value: ptr.To("warning")},
+				Value: r5.String{Value: ptr.To(w)},
+			})
+		}
+		paramsPart.Part = append(paramsPart.Part, warningsParam)
+	}
+
+	if inputs.timing {
+		paramsPart.Part = append(paramsPart.Part, timingPartR5(result, inputs, time.Since(start)))
+	}
+
 	out.Parameter = append(out.Parameter, paramsPart)
 	return out
 }
 
+// timingPartR5 reports the microseconds spent in each phase of the evaluation,
+// with one evaluate part per context item
+func timingPartR5(result evalResult, inputs evalInputs, serialize time.Duration) r5.ParametersParameter {
+	phase := func(name string, d time.Duration) r5.ParametersParameter {
+		return r5.ParametersParameter{
+			Name:  r5.String{Value: ptr.To(name)},
+			Value: microseconds[r5.Decimal](d),
+		}
+	}
+
+	timing := r5.ParametersParameter{
+		Name: r5.String{Value: ptr.To("timing")},
+		Part: []r5.ParametersParameter{
+			phase("decodeResource", inputs.decodeResource),
+			phase("parseExpression", result.timings.parseExpression),
+		},
+	}
+	if inputs.context != "" {
+		timing.Part = append(timing.Part,
+			phase("parseContext", result.timings.parseContext),
+			phase("evaluateContext", result.timings.evaluateContext))
+	}
+	for _, res := range result.results {
+		timing.Part = append(timing.Part, phase("evaluate", res.evaluation))
+	}
+	timing.Part = append(timing.Part, phase("serialize", serialize))
+	return timing
+}
+
 // makePartsR5 converts FHIRPath collection to R5 parameter parts
 func makePartsR5(values fhirpath.Collection) []r5.ParametersParameter {
 	var parts []r5.ParametersParameter
 
 	for _, v := range values {
 		tname := typeNameOf(v)
-
-		// Try to use value[x] first for primitive types
+		// The qualified type tells System-typed values from FHIR elements
+		qualifiedType := qualifiedTypeName(v)
+		typeExts := []r5.Extension{{
+			Url:   typeExtensionURL,
+			Value: r5.String{Value: &qualifiedType},
+		}}
+
+		// Try to use value[x] first for primitive types, System types map to the matching FHIR type
 		pv, ok := v.(r5.ParametersParameterValue)
+		if !ok {
+			pv, ok = systemParameterValueR5(v)
+		}
 		if ok {
-			parts = append(parts, r5.ParametersParameter{Name: r5.String{Value: &tname}, Value: pv})
+			parts = append(parts, r5.ParametersParameter{
+				Name:      r5.String{Value: &tname},
+				Extension: typeExts,
+				Value:     pv,
+			})
 			continue
 		}
 
 		// For everything else (resources, complex types, etc.), use json-value extension
-		jsonBytes, err := json.Marshal(v)
+		jsonStr, err := encodeFHIRJSON(v)
 		if err == nil {
-			jsonStr := string(jsonBytes)
 			parts = append(parts, r5.ParametersParameter{
 				Name: r5.String{Value: &tname},
-				Extension: []r5.Extension{{
-					Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
-					Value: r5.String{Value: &jsonStr},
-				}},
+				Extension: append([]r5.Extension{
+					{
+						Url:   "http://fhir.forms-lab.com/StructureDefinition/json-value",
+						Value: r5.String{Value: &jsonStr},
+					},
+				}, typeExts...),
 			})
 		}
 	}
 	return parts
 }
 
+// primitiveElementR5 returns the id and extensions of a R5 primitive.
+func primitiveElementR5(v any) (primitiveMeta, bool) {
+	switch p := v.(type) {
+	case r5.Integer64:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Base64Binary:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Boolean:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Canonical:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Code:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Date:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.DateTime:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Decimal:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Id:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Instant:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Integer:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Markdown:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Oid:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.PositiveInt:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.String:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Time:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.UnsignedInt:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Uri:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Url:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	case r5.Uuid:
+		return primitiveMetaOf(p.Id, p.Extension), true
+	}
+	return primitiveMeta{}, false
+}
+
+// systemParameterValueR5 converts a System-typed value to the R5 value[x] it maps to,
+// keeping its lexical form and precision.
+func systemParameterValueR5(v fhirpath.Element) (r5.ParametersParameterValue, bool) {
+	sv, ok := systemValueOf(v)
+	if !ok {
+		return nil, false
+	}
+	switch sv.fhirType {
+	case "boolean":
+		return r5.Boolean{Value: &sv.boolean}, true
+	case "integer":
+		return r5.Integer{Value: &sv.integer}, true
+	case "integer64":
+		return r5.Integer64{Value: &sv.long}, true
+	case "decimal":
+		return r5.Decimal{Value: sv.decimal.Value}, true
+	case "date":
+		return r5.Date{Value: &sv.lexical}, true
+	case "dateTime":
+		return r5.DateTime{Value: &sv.lexical}, true
+	case "time":
+		return r5.Time{Value: &sv.lexical}, true
+	case "Quantity":
+		q := r5.Quantity{Value: &r5.Decimal{Value: sv.decimal.Value}}
+		if sv.unit != "" {
+			q.Unit = &r5.String{Value: &sv.unit}
+		}
+		if sv.ucum {
+			q.System = &r5.Uri{Value: ptr.To("http://unitsofmeasure.org")}
+			q.Code = &r5.Code{Value: &sv.unit}
+		}
+		return q, true
+	default:
+		return r5.String{Value: &sv.lexical}, true
+	}
+}
+
 // opErrR5 creates R5 OperationOutcome for errors
 func opErrR5(severity, code, diagnostics string) r5.OperationOutcome {
 	return r5.OperationOutcome{Issue: []r5.OperationOutcomeIssue{{
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"github.com/damedic/fhir-toolbox-go/model/gen/r4"
+	"github.com/damedic/fhir-toolbox-go/model/gen/r4b"
+	"github.com/damedic/fhir-toolbox-go/model/gen/r5"
+	"github.com/damedic/fhir-toolbox-go/utils/ptr"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const toolboxModule = "github.com/damedic/fhir-toolbox-go"
+
+// BuildInfo describes the running build, as recorded by the Go toolchain.
+type BuildInfo struct {
+	// Version is the main module version, "(devel)" for builds from a working copy.
+	Version            string `json:"version"`
+	FHIRToolboxVersion string `json:"fhirToolboxVersion,omitempty"`
+	Revision           string `json:"revision,omitempty"`
+	RevisionTime       string `json:"revisionTime,omitempty"`
+	Modified           bool   `json:"modified,omitempty"`
+	GoVersion          string `json:"goVersion"`
+}
+
+// ReadBuildInfo returns the build info of the running binary.
+var ReadBuildInfo = sync.OnceValue(func() BuildInfo {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{Version: "(devel)"}
+	}
+	info := BuildInfo{Version: bi.Main.Version, GoVersion: bi.GoVersion}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == toolboxModule {
+			info.FHIRToolboxVersion = dep.Version
+			if dep.Replace != nil {
+				info.FHIRToolboxVersion = dep.Replace.Version
+			}
+		}
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.RevisionTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+})
+
+// SoftwareVersion is the version reported in the CapabilityStatement: the module version for
+// released builds, otherwise the (abbreviated) VCS revision.
+func (bi BuildInfo) SoftwareVersion() string {
+	if bi.Version != "(devel)" {
+		return bi.Version
+	}
+	if bi.Revision != "" {
+		v := bi.Revision
+		if len(v) > 12 {
+			v = v[:12]
+		}
+		if bi.Modified {
+			v += "-dirty"
+		}
+		return v
+	}
+	return bi.Version
+}
+
+// HealthHandler reports that the process is serving requests.
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// VersionHandler reports the build info of the running binary.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ReadBuildInfo())
+	})
+}
+
+// readinessTTL is how long a readiness result is reused, so frequent probes don't evaluate each time.
+const readinessTTL = 5 * time.Second
+
+// readiness is the cached outcome of the readiness self-test.
+type readiness struct {
+	mu       sync.Mutex
+	checked  time.Time
+	code     int
+	response map[string]any
+}
+
+// ReadinessHandler runs a canned evaluation in every release and reports ready only if all
+// of them return the expected result. The result is reused for readinessTTL.
+func ReadinessHandler() http.Handler {
+	var cached readiness
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cached.mu.Lock()
+		if cached.response == nil || time.Since(cached.checked) >= readinessTTL {
+			// The result outlives the request, don't let its cancellation fail the check
+			cached.code, cached.response = checkReadiness(context.WithoutCancel(r.Context()))
+			cached.checked = time.Now()
+		}
+		code, response := cached.code, cached.response
+		cached.mu.Unlock()
+		writeJSON(w, code, response)
+	})
+}
+
+func checkReadiness(ctx context.Context) (int, map[string]any) {
+	// The self-test is not the request's evaluation, keep it out of its logs and metrics
+	ctx = context.WithValue(ctx, requestInfoKey{}, &requestInfo{})
+	releases := map[string]string{}
+	status, code := "ready", http.StatusOK
+	for release, check := range map[string]func(context.Context) error{
+		"R4":  selfTest[model.R4],
+		"R4B": selfTest[model.R4B],
+		"R5":  selfTest[model.R5],
+	} {
+		releases[release] = "ok"
+		if err := check(ctx); err != nil {
+			releases[release] = err.Error()
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	return code, map[string]any{"status": status, "releases": releases}
+}
+
+// selfTest evaluates name.given on a minimal Patient of release R.
+func selfTest[R model.Release](ctx context.Context) error {
+	var release R
+	var patient model.Resource
+	switch any(release).(type) {
+	case model.R4B:
+		patient = r4b.Patient{Name: []r4b.HumanName{{Given: []r4b.String{{Value: ptr.To("Alice")}}}}}
+	case model.R5:
+		patient = r5.Patient{Name: []r5.HumanName{{Given: []r5.String{{Value: ptr.To("Alice")}}}}}
+	default:
+		patient = r4.Patient{Name: []r4.HumanName{{Given: []r4.String{{Value: ptr.To("Alice")}}}}}
+	}
+
+	result := evalFHIRPath[R](ctx, evalInputs{expression: "Patient.name.given", resource: patient})
+	if result.error != nil {
+		return result.error
+	}
+	if len(result.results) != 1 || len(result.results[0].values) != 1 {
+		return fmt.Errorf("unexpected result %v", result.results)
+	}
+	if s, ok, err := result.results[0].values[0].ToString(false); err != nil || !ok || s != "Alice" {
+		return fmt.Errorf("unexpected result %v", result.results[0].values[0])
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -2,22 +2,61 @@ package internal
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"flag"
+	"fmt"
 	"github.com/damedic/fhir-toolbox-go/model"
+	"github.com/damedic/fhir-toolbox-go/model/gen/r4"
+	"github.com/damedic/fhir-toolbox-go/model/gen/r5"
 	"github.com/damedic/fhir-toolbox-go/rest"
 	"github.com/damedic/fhir-toolbox-go/utils/ptr"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 // minimal helpers to navigate Parameters JSON
 type param struct {
-	Name        string  `json:"name"`
-	ValueString *string `json:"valueString,omitempty"`
-	Resource    any     `json:"resource,omitempty"`
-	Part        []param `json:"part,omitempty"`
-	Extension   []struct {
+	Name         string      `json:"name"`
+	ValueString  *string     `json:"valueString,omitempty"`
+	ValueBoolean *bool       `json:"valueBoolean,omitempty"`
+	ValueDecimal json.Number `json:"valueDecimal,omitempty"`
+	// ValueStringElement holds the id and extensions of valueString
+	ValueStringElement map[string]any `json:"_valueString,omitempty"`
+	Resource           any            `json:"resource,omitempty"`
+	Part               []param        `json:"part,omitempty"`
+	Extension          []struct {
 		Url         string  `json:"url"`
 		ValueString *string `json:"valueString,omitempty"`
 	} `json:"extension,omitempty"`
@@ -69,6 +108,16 @@ func findParams(parts []param, name string) []param {
 	return out
 }
 
+// jsonValue returns the json-value extension content of a part, if any.
+func jsonValue(p param) string {
+	for _, ext := range p.Extension {
+		if ext.Url == "http://fhir.forms-lab.com/StructureDefinition/json-value" && ext.ValueString != nil {
+			return *ext.ValueString
+		}
+	}
+	return ""
+}
+
 func TestIntegration(t *testing.T) {
 	ts := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
 	defer ts.Close()
@@ -295,3 +344,2494 @@ func TestJsonValueExtension(t *testing.T) {
 		t.Fatalf("expected Patient result to have json-value extension")
 	}
 }
+
+func TestResolve(t *testing.T) {
+	ts := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
+	defer ts.Close()
+
+	bundle := map[string]any{
+		"resourceType": "Bundle",
+		"type":         "collection",
+		"entry": []any{
+			map[string]any{
+				"fullUrl": "urn:uuid:8e3a4f0c-2b1d-4c5e-9f6a-7b8c9d0e1f2a",
+				"resource": map[string]any{
+					"resourceType": "Patient",
+					"id":           "pat1",
+					"name":         []any{map[string]any{"given": []string{"Alice"}}},
+				},
+			},
+			map[string]any{
+				"fullUrl": "http://example.org/fhir/Practitioner/prac1",
+				"resource": map[string]any{
+					"resourceType": "Practitioner",
+					"id":           "prac1",
+					"name":         []any{map[string]any{"given": []string{"Bob"}}},
+				},
+			},
+			map[string]any{
+				"resource": map[string]any{
+					"resourceType": "Observation",
+					"id":           "obs1",
+					"status":       "final",
+					"code":         map[string]any{"text": "test"},
+					"contained": []any{
+						map[string]any{"resourceType": "Practitioner", "id": "c1", "name": []any{map[string]any{"given": []string{"Carol"}}}},
+					},
+					"subject":   map[string]any{"reference": "urn:uuid:8e3a4f0c-2b1d-4c5e-9f6a-7b8c9d0e1f2a"},
+					"performer": []any{map[string]any{"reference": "Practitioner/prac1"}, map[string]any{"reference": "#c1"}, map[string]any{"reference": "Practitioner/missing"}},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		want       []string
+	}{
+		{name: "fullUrl", expression: "Bundle.entry.resource.ofType(Observation).subject.resolve().name.given", want: []string{"Alice"}},
+		{name: "relative and contained", expression: "Bundle.entry.resource.ofType(Observation).performer.resolve().name.given", want: []string{"Bob", "Carol"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(tc.expression)},
+				{Name: "resource", Resource: bundle},
+			}})
+			results := findParams(got.Parameter, "result")
+			if len(results) != 1 {
+				t.Fatalf("expected one result, got %d", len(results))
+			}
+			var values []string
+			for _, p := range results[0].Part {
+				if p.ValueString != nil {
+					values = append(values, *p.ValueString)
+				}
+			}
+			if len(values) != len(tc.want) {
+				t.Fatalf("got %v, want %v", values, tc.want)
+			}
+			for i := range values {
+				if values[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", values, tc.want)
+				}
+			}
+		})
+	}
+
+	t.Run("unresolvable warning", func(t *testing.T) {
+		got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("Bundle.entry.resource.ofType(Observation).performer.resolve()")},
+			{Name: "resource", Resource: bundle},
+		}})
+		warnings := findParam(findParam(got.Parameter, "parameters").Part, "warnings")
+		if warnings == nil || len(warnings.Part) != 1 || warnings.Part[0].ValueString == nil {
+			t.Fatalf("expected a single warning, got %+v", warnings)
+		}
+		if *warnings.Part[0].ValueString != "unable to resolve reference 'Practitioner/missing'" {
+			t.Fatalf("unexpected warning: %s", *warnings.Part[0].ValueString)
+		}
+	})
+
+	t.Run("entry scope", func(t *testing.T) {
+		// Both entries contain a #p, and the Observation's entry is the base for relative references
+		scoped := map[string]any{
+			"resourceType": "Bundle",
+			"type":         "collection",
+			"entry": []any{
+				map[string]any{
+					"fullUrl": "http://mine.example/fhir/Patient/1",
+					"resource": map[string]any{
+						"resourceType":        "Patient",
+						"id":                  "1",
+						"name":                []any{map[string]any{"given": []string{"Alice"}}},
+						"contained":           []any{map[string]any{"resourceType": "Practitioner", "id": "p", "name": []any{map[string]any{"given": []string{"Dana"}}}}},
+						"generalPractitioner": []any{map[string]any{"reference": "#p"}},
+					},
+				},
+				map[string]any{
+					"fullUrl": "http://mine.example/fhir/Observation/o",
+					"resource": map[string]any{
+						"resourceType": "Observation",
+						"id":           "o",
+						"status":       "final",
+						"code":         map[string]any{"text": "test"},
+						"contained":    []any{map[string]any{"resourceType": "Practitioner", "id": "p", "name": []any{map[string]any{"given": []string{"Erin"}}}}},
+						"subject":      map[string]any{"reference": "http://other.example/fhir/Patient/1"},
+						"performer":    []any{map[string]any{"reference": "Patient/1"}, map[string]any{"reference": "#p"}},
+					},
+				},
+			},
+		}
+		for expression, want := range map[string]string{
+			"Bundle.entry.resource.ofType(Observation).performer.resolve().name.given":       "Alice Erin",
+			"Bundle.entry.resource.ofType(Patient).generalPractitioner.resolve().name.given": "Dana",
+			"Bundle.entry.resource.ofType(Observation).subject.resolve().name.given":         "",
+		} {
+			got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(expression)},
+				{Name: "resource", Resource: scoped},
+			}})
+			var values []string
+			for _, p := range findParam(got.Parameter, "result").Part {
+				if p.ValueString != nil {
+					values = append(values, *p.ValueString)
+				}
+			}
+			if strings.Join(values, " ") != want {
+				t.Errorf("%s: got %v, want %s", expression, values, want)
+			}
+		}
+	})
+
+	t.Run("type and id fallback in RESTful entry", func(t *testing.T) {
+		// The Patient has no RESTful fullUrl below the Observation's base, so only its type and id match
+		mixed := map[string]any{
+			"resourceType": "Bundle",
+			"type":         "collection",
+			"entry": []any{
+				map[string]any{
+					"fullUrl":  "urn:uuid:0b6e2f4c-9a1d-4e3b-8c7f-5d2a1e0f9b8c",
+					"resource": map[string]any{"resourceType": "Patient", "id": "2", "name": []any{map[string]any{"given": []string{"Frank"}}}},
+				},
+				map[string]any{
+					"fullUrl": "http://mine.example/fhir/Observation/o",
+					"resource": map[string]any{
+						"resourceType": "Observation",
+						"id":           "o",
+						"status":       "final",
+						"code":         map[string]any{"text": "test"},
+						"subject":      map[string]any{"reference": "Patient/2"},
+					},
+				},
+			},
+		}
+		got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("Bundle.entry.resource.ofType(Observation).subject.resolve().name.given")},
+			{Name: "resource", Resource: mixed},
+		}})
+		values := findParam(got.Parameter, "result").Part
+		if len(values) != 1 || values[0].ValueString == nil || *values[0].ValueString != "Frank" {
+			t.Fatalf("expected Frank, got %+v", values)
+		}
+	})
+}
+
+func TestResolveFromStore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"patient.json": `{"resourceType":"Patient","id":"p1","name":[{"given":["Ann"]}]}`,
+		"bundle.json":  `{"resourceType":"Bundle","type":"collection","entry":[{"fullUrl":"http://example.org/fhir/ValueSet/vs1","resource":{"resourceType":"ValueSet","id":"vs1","url":"http://example.org/vs","version":"1.0","name":"VS1","status":"active"}}]}`,
+		"vs10.json":    `{"resourceType":"ValueSet","id":"vs10","url":"http://example.org/vs","version":"1.10","name":"VS10","status":"active"}`,
+		"vs9.json":     `{"resourceType":"ValueSet","id":"vs9","url":"http://example.org/vs","version":"1.9","name":"VS9","status":"active"}`,
+		"invalid.json": `{"resourceType":"Patient","id":"invalid","active":"yes"}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	store, err := LoadResourceStore(dir)
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+
+	ts := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: "", Store: store}})
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		expression string
+		want       string
+	}{
+		{name: "R4 type/id", path: "/$fhirpath", expression: "Observation.subject.resolve().name.given", want: "Ann"},
+		{name: "R5 type/id", path: "/$fhirpath-r5", expression: "Observation.subject.resolve().name.given", want: "Ann"},
+		{name: "canonical", path: "/$fhirpath", expression: "'http://example.org/vs|1.0'.resolve().name", want: "VS1"},
+		{name: "highest version", path: "/$fhirpath", expression: "'http://example.org/vs'.resolve().name", want: "VS10"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := postJSON(t, ts, tc.path, parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(tc.expression)},
+				{Name: "resource", Resource: map[string]any{
+					"resourceType": "Observation",
+					"status":       "final",
+					"code":         map[string]any{"text": "test"},
+					"subject":      map[string]any{"reference": "Patient/p1"},
+				}},
+			}})
+			results := findParams(got.Parameter, "result")
+			if len(results) != 1 || len(results[0].Part) != 1 || results[0].Part[0].ValueString == nil {
+				t.Fatalf("expected a single string result, got %+v", results)
+			}
+			if *results[0].Part[0].ValueString != tc.want {
+				t.Fatalf("got %q, want %q", *results[0].Part[0].ValueString, tc.want)
+			}
+		})
+	}
+
+	for expression, want := range map[string]string{
+		"'http://example.org/vs|2.0'.resolve()": "unable to resolve reference 'http://example.org/vs|2.0': version 2.0 of http://example.org/vs is not in the store",
+		"'Patient/invalid'.resolve()":           "unable to resolve reference 'Patient/invalid': stored Patient/invalid can not be decoded as R4",
+		// Absolute references to another server are not matched by type and id
+		"'http://other.example.com/fhir/Patient/p1'.resolve()": "unable to resolve reference 'http://other.example.com/fhir/Patient/p1'",
+	} {
+		got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To(expression)},
+			{Name: "resource", Resource: map[string]any{"resourceType": "Patient"}},
+		}})
+		if r := findParam(got.Parameter, "result"); r != nil && len(r.Part) != 0 {
+			t.Errorf("%s: expected no result, got %+v", expression, r.Part)
+		}
+		warnings := findParam(findParam(got.Parameter, "parameters").Part, "warnings")
+		if warnings == nil || len(warnings.Part) != 1 || !strings.HasPrefix(*warnings.Part[0].ValueString, want) {
+			t.Errorf("%s: expected the warning %q, got %+v", expression, want, warnings)
+		}
+	}
+
+	duplicate := t.TempDir()
+	for _, name := range []string{"a.json", "b.json"} {
+		if err := os.WriteFile(filepath.Join(duplicate, name), []byte(files["vs9.json"]), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if _, err := LoadResourceStore(duplicate); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("expected duplicate canonical versions to be rejected, got %v", err)
+	}
+
+	duplicateID := t.TempDir()
+	for name, content := range map[string]string{
+		"a.json": files["patient.json"],
+		"b.json": `{"resourceType":"Patient","id":"p1","name":[{"given":["Bea"]}]}`,
+	} {
+		if err := os.WriteFile(filepath.Join(duplicateID, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if _, err := LoadResourceStore(duplicateID); err == nil || !strings.Contains(err.Error(), "duplicate Patient/p1") {
+		t.Errorf("expected duplicate type and id to be rejected, got %v", err)
+	}
+}
+
+func TestEnvironmentVariables(t *testing.T) {
+	ts := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		expression string
+		context    string
+	}{
+		{name: "ucum", expression: "%ucum = 'http://unitsofmeasure.org'"},
+		{name: "sct", expression: "%sct = 'http://snomed.info/sct'"},
+		{name: "loinc", expression: "%loinc = 'http://loinc.org'"},
+		{name: "vs", expression: "%`vs-administrative-gender` = 'http://hl7.org/fhir/ValueSet/administrative-gender'"},
+		{name: "ext", expression: "%'ext-patient-birthPlace' = 'http://hl7.org/fhir/StructureDefinition/patient-birthPlace'"},
+		{name: "context root", expression: "%context.name.given.first() = 'Alice'"},
+		{name: "context item", expression: "%context.given.first() = given.first()", context: "name"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body := parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(tc.expression)},
+				{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}, map[string]any{"given": []string{"Jim"}}}}},
+			}}
+			if tc.context != "" {
+				body.Parameter = append(body.Parameter, param{Name: "context", ValueString: ptr.To(tc.context)})
+			}
+			got := postJSON(t, ts, "/$fhirpath", body)
+			results := findParams(got.Parameter, "result")
+			if len(results) == 0 {
+				t.Fatalf("result missing")
+			}
+			for _, res := range results {
+				if len(res.Part) != 1 || res.Part[0].ValueBoolean == nil || !*res.Part[0].ValueBoolean {
+					t.Fatalf("expected true, got %+v", res.Part)
+				}
+			}
+		})
+	}
+}
+
+func TestResourceScope(t *testing.T) {
+	ts := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
+	defer ts.Close()
+
+	patient := func(id, orgName string) map[string]any {
+		return map[string]any{
+			"resourceType":         "Patient",
+			"id":                   id,
+			"contained":            []any{map[string]any{"resourceType": "Organization", "id": "org", "name": orgName}},
+			"managingOrganization": map[string]any{"reference": "#org"},
+		}
+	}
+	bundle := map[string]any{
+		"resourceType": "Bundle",
+		"id":           "b1",
+		"type":         "collection",
+		"entry": []any{
+			map[string]any{"resource": patient("pat1", "A Org")},
+			map[string]any{"resource": patient("pat2", "B Org")},
+		},
+	}
+
+	post := func(t *testing.T, expression, context string) []param {
+		got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To(expression)},
+			{Name: "context", ValueString: ptr.To(context)},
+			{Name: "resource", Resource: bundle},
+		}})
+		if warnings := findParam(findParam(got.Parameter, "parameters").Part, "warnings"); warnings != nil {
+			t.Fatalf("unexpected warnings: %+v", warnings.Part)
+		}
+		return findParams(got.Parameter, "result")
+	}
+
+	scopes := []struct {
+		name       string
+		expression string
+		context    string
+	}{
+		{name: "entry resource", context: "Bundle.entry.resource", expression: "%resource.id = id and %rootResource.id = id"},
+		{name: "contained resource", context: "Bundle.entry.resource.contained", expression: "%resource.id = 'org' and %rootResource.id.startsWith('pat')"},
+		{name: "element in contained", context: "Bundle.entry.resource.contained.name", expression: "%resource.ofType(Organization).name = $this and %rootResource.ofType(Patient).exists()"},
+		{name: "element in entry", context: "Bundle.entry.resource.managingOrganization", expression: "%resource.managingOrganization.reference = reference and %resource.id != 'b1'"},
+	}
+	for _, tc := range scopes {
+		t.Run(tc.name, func(t *testing.T) {
+			results := post(t, tc.expression, tc.context)
+			if len(results) != 2 {
+				t.Fatalf("expected two results, got %d", len(results))
+			}
+			for _, res := range results {
+				if len(res.Part) != 1 || res.Part[0].ValueBoolean == nil || !*res.Part[0].ValueBoolean {
+					t.Fatalf("expected true for %s, got %+v", *res.ValueString, res.Part)
+				}
+			}
+		})
+	}
+
+	t.Run("contained resolved in container", func(t *testing.T) {
+		results := post(t, "managingOrganization.resolve().name", "Bundle.entry.resource")
+		want := []string{"A Org", "B Org"}
+		if len(results) != len(want) {
+			t.Fatalf("expected %d results, got %d", len(want), len(results))
+		}
+		for i, res := range results {
+			if len(res.Part) != 1 || res.Part[0].ValueString == nil || *res.Part[0].ValueString != want[i] {
+				t.Fatalf("result %d: expected %q, got %+v", i, want[i], res.Part)
+			}
+		}
+	})
+
+	// References and primitives reached through choice types, in entries and contained resources
+	scopedPatient := func(id, orgName string) map[string]any {
+		return map[string]any{
+			"resourceType": "Patient",
+			"id":           id,
+			"contained": []any{
+				map[string]any{"resourceType": "Organization", "id": "org", "name": orgName, "extension": []any{
+					map[string]any{"url": "http://example.org/location", "valueReference": map[string]any{"reference": "#loc"}},
+					map[string]any{"url": "http://example.org/location-uri", "valueUri": "#loc"},
+				}},
+				map[string]any{"resourceType": "Location", "id": "loc", "name": orgName + " Loc"},
+			},
+			"extension": []any{
+				map[string]any{"url": "http://example.org/organization-" + id, "valueReference": map[string]any{"reference": "#org"}},
+			},
+		}
+	}
+	choices := map[string]any{
+		"resourceType": "Bundle",
+		"type":         "collection",
+		"entry": []any{
+			map[string]any{"resource": scopedPatient("pat1", "A Org")},
+			map[string]any{"resource": scopedPatient("pat2", "B Org")},
+		},
+	}
+	postChoices := func(t *testing.T, expression, context string) ([]param, *param) {
+		got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To(expression)},
+			{Name: "context", ValueString: ptr.To(context)},
+			{Name: "resource", Resource: choices},
+		}})
+		return findParams(got.Parameter, "result"), findParam(findParam(got.Parameter, "parameters").Part, "warnings")
+	}
+
+	choiceScopes := []struct {
+		name       string
+		expression string
+		context    string
+		count      int
+	}{
+		{name: "reference in choice in entry", context: "Bundle.entry.resource.extension.value", expression: "resolve().name = iif(%rootResource.id = 'pat1', 'A Org', 'B Org')", count: 2},
+		{name: "reference and uri in choice in contained", context: "Bundle.entry.resource.contained.extension.value", expression: "resolve().name = %resource.name + ' Loc' and %rootResource.ofType(Patient).exists()", count: 4},
+		{name: "primitive without identity", context: "Bundle.entry.resource.extension.url", expression: "%resource.extension.url contains $this and %resource.id.startsWith('pat')", count: 2},
+	}
+	for _, tc := range choiceScopes {
+		t.Run(tc.name, func(t *testing.T) {
+			results, warnings := postChoices(t, tc.expression, tc.context)
+			if warnings != nil {
+				t.Fatalf("unexpected warnings: %+v", warnings.Part)
+			}
+			if len(results) != tc.count {
+				t.Fatalf("expected %d results, got %d", tc.count, len(results))
+			}
+			for _, res := range results {
+				if len(res.Part) != 1 || res.Part[0].ValueBoolean == nil || !*res.Part[0].ValueBoolean {
+					t.Fatalf("expected true for %s, got %+v", *res.ValueString, res.Part)
+				}
+			}
+		})
+	}
+
+	t.Run("resolve through choice without context", func(t *testing.T) {
+		results, warnings := postChoices(t, "Bundle.entry.resource.contained.extension.value.resolve().name | Bundle.entry.resource.extension.value.resolve().name", "")
+		if warnings != nil {
+			t.Fatalf("unexpected warnings: %+v", warnings.Part)
+		}
+		var values []string
+		for _, p := range results[0].Part {
+			values = append(values, *p.ValueString)
+		}
+		if want := []string{"A Org Loc", "B Org Loc", "A Org", "B Org"}; !slices.Equal(values, want) {
+			t.Fatalf("got %v, want %v", values, want)
+		}
+	})
+
+	t.Run("ambiguous element", func(t *testing.T) {
+		// Both organizations have the same extension url, which carries no identity of its own
+		results, warnings := postChoices(t, "%resource.id = 'pat1'", "Bundle.entry.resource.contained.extension.url")
+		if len(results) != 4 {
+			t.Fatalf("expected 4 results, got %d", len(results))
+		}
+		// One warning per url
+		if warnings == nil || len(warnings.Part) != 2 {
+			t.Fatalf("expected warnings about the ambiguous elements, got %+v", warnings)
+		}
+		for _, w := range warnings.Part {
+			if !strings.Contains(*w.ValueString, "occurs in several resources") {
+				t.Fatalf("expected a warning about the ambiguous element, got %s", *w.ValueString)
+			}
+		}
+	})
+}
+
+func TestXMLFormat(t *testing.T) {
+	ts := httptest.NewServer(NegotiateFormat(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})))
+	defer ts.Close()
+
+	body := `<Parameters xmlns="http://hl7.org/fhir">` +
+		`<parameter><name value="expression"/><valueString value="name.given"/></parameter>` +
+		`<parameter><name value="resource"/><resource><Patient><name><given value="Alice"/></name></Patient></resource></parameter>` +
+		`</Parameters>`
+
+	for _, path := range []string{"/$fhirpath", "/$fhirpath-r4b", "/$fhirpath-r5"} {
+		t.Run(path, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/fhir+xml; charset=utf-8")
+			req.Header.Set("Accept", "application/fhir+json;q=0.5, application/fhir+xml;q=0.9")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/fhir+xml" {
+				t.Fatalf("unexpected content type %q", ct)
+			}
+			var got struct {
+				Parameter []struct {
+					Name struct {
+						Value string `xml:"value,attr"`
+					} `xml:"name"`
+					Part []struct {
+						ValueString struct {
+							Value string `xml:"value,attr"`
+						} `xml:"valueString"`
+					} `xml:"part"`
+				} `xml:"parameter"`
+			}
+			if err := xml.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(got.Parameter) == 0 || got.Parameter[0].Name.Value != "result" ||
+				len(got.Parameter[0].Part) != 1 || got.Parameter[0].Part[0].ValueString.Value != "Alice" {
+				t.Fatalf("unexpected response: %+v", got)
+			}
+		})
+	}
+
+	t.Run("response in request format", func(t *testing.T) {
+		for _, tc := range []struct{ accept, want string }{
+			{want: "application/fhir+xml"},
+			{accept: "*/*", want: "application/fhir+xml"},
+			{accept: "application/json", want: "application/fhir+json"},
+		} {
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/fhir+xml")
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != tc.want {
+				t.Errorf("Accept %q: expected %s, got %d %q", tc.accept, tc.want, resp.StatusCode, ct)
+			}
+		}
+	})
+
+	t.Run("xml-value extension", func(t *testing.T) {
+		got := postJSON(t, ts, "/$fhirpath-r5", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("name.given")},
+			{Name: "resource", Extension: []struct {
+				Url         string  `json:"url"`
+				ValueString *string `json:"valueString,omitempty"`
+			}{
+				{
+					Url:         "http://fhir.forms-lab.com/StructureDefinition/xml-value",
+					ValueString: ptr.To(`<Patient xmlns="http://hl7.org/fhir"><name><given value="Bob"/></name></Patient>`),
+				},
+			}},
+		}})
+		results := findParams(got.Parameter, "result")
+		if len(results) != 1 || len(results[0].Part) != 1 || results[0].Part[0].ValueString == nil || *results[0].Part[0].ValueString != "Bob" {
+			t.Fatalf("unexpected result: %+v", results)
+		}
+	})
+}
+
+func TestReleaseParameters(t *testing.T) {
+	ts := httptest.NewServer(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		expression string
+		resource   map[string]any
+		want       string
+	}{
+		{
+			name:       "R4B inline",
+			path:       "/$fhirpath-r4b",
+			expression: "name.given",
+			resource:   map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}},
+			want:       "Alice",
+		},
+		{
+			name:       "R5-only resource",
+			path:       "/$fhirpath-r5",
+			expression: "ActorDefinition.title",
+			resource:   map[string]any{"resourceType": "ActorDefinition", "status": "active", "type": "person", "title": "Doctor"},
+			want:       "Doctor",
+		},
+		{
+			name:       "R5-only element",
+			path:       "/$fhirpath-r5",
+			expression: "Observation.triggeredBy.reason",
+			resource:   map[string]any{"resourceType": "Observation", "status": "final", "code": map[string]any{"text": "x"}, "triggeredBy": []any{map[string]any{"observation": map[string]any{"reference": "Observation/o1"}, "type": "reflex", "reason": "abnormal"}}},
+			want:       "abnormal",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := postJSON(t, ts, tc.path, parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(tc.expression)},
+				{Name: "variables", Part: []param{{Name: "v", ValueString: ptr.To("x")}}},
+				{Name: "resource", Resource: tc.resource},
+			}})
+			results := findParams(got.Parameter, "result")
+			if len(results) != 1 || len(results[0].Part) != 1 || results[0].Part[0].ValueString == nil {
+				t.Fatalf("expected a single native valueString result, got %+v", results)
+			}
+			if *results[0].Part[0].ValueString != tc.want {
+				t.Fatalf("got %q, want %q", *results[0].Part[0].ValueString, tc.want)
+			}
+		})
+	}
+
+	t.Run("element unknown in the release", func(t *testing.T) {
+		// Device.deviceName exists in R4 but was renamed to name in R5
+		b, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("deviceName.name")},
+			{Name: "resource", Resource: map[string]any{"resourceType": "Device", "deviceName": []any{map[string]any{"name": "Pump", "type": "user-friendly-name"}}}},
+		}})
+		resp, err := http.Post(ts.URL+"/$fhirpath-r5", "application/fhir+json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "OperationOutcome") || !strings.Contains(string(body), "deviceName") {
+			t.Fatalf("expected 400 with an OperationOutcome naming deviceName, got %d %s", resp.StatusCode, body)
+		}
+	})
+}
+
+func TestReleaseDetection(t *testing.T) {
+	ts := httptest.NewServer(NegotiateFormat(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})))
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		contentType  string
+		resource     map[string]any
+		wantRelease  string
+		wantWarnings []string
+	}{
+		{
+			name:        "R4 by default",
+			resource:    map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}},
+			wantRelease: "R4",
+		},
+		{
+			name:        "R5-only resource",
+			resource:    map[string]any{"resourceType": "ActorDefinition", "status": "active", "type": "person"},
+			wantRelease: "R5",
+		},
+		{
+			name:        "R5-only element",
+			resource:    map[string]any{"resourceType": "Observation", "status": "final", "code": map[string]any{"text": "x"}, "triggeredBy": []any{map[string]any{"observation": map[string]any{"reference": "Observation/o1"}, "type": "reflex"}}},
+			wantRelease: "R5",
+		},
+		{
+			name:        "fhirVersion element",
+			resource:    map[string]any{"resourceType": "CapabilityStatement", "status": "active", "kind": "instance", "fhirVersion": "5.0.0"},
+			wantRelease: "R5",
+		},
+		{
+			name:        "fhirVersion mime parameter",
+			contentType: "application/fhir+json; fhirVersion=4.3",
+			resource:    map[string]any{"resourceType": "Patient"},
+			wantRelease: "R4B",
+		},
+		{
+			name:         "unknown element",
+			resource:     map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}, "favouriteColour": "blue"},
+			wantRelease:  "R4",
+			wantWarnings: []string{"element 'favouriteColour' (Patient) is unknown in R4 and was ignored"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To("1 = 1")},
+				{Name: "resource", Resource: tc.resource},
+			}})
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath-auto", bytes.NewReader(b))
+			req.Header.Set("Content-Type", "application/fhir+json")
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			var got parameters
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			paramsPart := findParam(got.Parameter, "parameters")
+			release := findParam(paramsPart.Part, "detectedRelease")
+			if release == nil || release.ValueString == nil || *release.ValueString != tc.wantRelease {
+				t.Fatalf("expected detected release %s, got %+v", tc.wantRelease, release)
+			}
+			eval := findParam(paramsPart.Part, "evaluator")
+			if *eval.ValueString != "fhir-toolbox-go ("+tc.wantRelease+")" {
+				t.Fatalf("unexpected evaluator %s", *eval.ValueString)
+			}
+			var warnings []string
+			if w := findParam(paramsPart.Part, "warnings"); w != nil {
+				for _, p := range w.Part {
+					warnings = append(warnings, *p.ValueString)
+				}
+			}
+			if strings.Join(warnings, "\n") != strings.Join(tc.wantWarnings, "\n") {
+				t.Fatalf("got warnings %v, want %v", warnings, tc.wantWarnings)
+			}
+		})
+	}
+
+	t.Run("unknown nested element valid elsewhere", func(t *testing.T) {
+		// Coding has no text, but HumanName and CodeableConcept have, and must keep theirs
+		got := postJSON(t, ts, "/$fhirpath-auto", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("contact.name.text | maritalStatus.text")},
+			{Name: "resource", Resource: map[string]any{
+				"resourceType":  "Patient",
+				"contact":       []any{map[string]any{"name": map[string]any{"text": "Bob"}}},
+				"maritalStatus": map[string]any{"coding": []any{map[string]any{"code": "M", "text": "oops"}}, "text": "Married"},
+			}},
+		}})
+		var values []string
+		for _, p := range findParam(got.Parameter, "result").Part {
+			values = append(values, *p.ValueString)
+		}
+		if strings.Join(values, " ") != "Bob Married" {
+			t.Errorf("expected only Coding.text dropped, got %v", values)
+		}
+		warnings := findParam(findParam(got.Parameter, "parameters").Part, "warnings")
+		if warnings == nil || len(warnings.Part) != 1 || *warnings.Part[0].ValueString != "element 'text' (Coding) is unknown in R4 and was ignored" {
+			t.Errorf("expected a warning for Coding.text, got %+v", warnings)
+		}
+	})
+
+	t.Run("unknown XML element", func(t *testing.T) {
+		body := `<Parameters xmlns="http://hl7.org/fhir">` +
+			`<parameter><name value="expression"/><valueString value="name.given"/></parameter>` +
+			`<parameter><name value="resource"/><resource><Patient>` +
+			`<text><status value="generated"/><div xmlns="http://www.w3.org/1999/xhtml"><p>Alice</p></div></text>` +
+			`<name><given value="Alice"/><nickname value="Al"/></name>` +
+			`</Patient></resource></parameter>` +
+			`</Parameters>`
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath-auto", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/fhir+xml")
+		req.Header.Set("Accept", "application/fhir+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		var got parameters
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		warnings := findParam(findParam(got.Parameter, "parameters").Part, "warnings")
+		if warnings == nil || len(warnings.Part) != 1 || *warnings.Part[0].ValueString != "element 'nickname' (Patient.name) is unknown in R4 and was ignored" {
+			t.Errorf("expected a warning for nickname, got %+v", warnings)
+		}
+	})
+
+	postXML := func(t *testing.T, body string) parameters {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath-auto", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/fhir+xml")
+		req.Header.Set("Accept", "application/fhir+json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		var got parameters
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return got
+	}
+
+	t.Run("fhirVersion XML element", func(t *testing.T) {
+		got := postXML(t, `<Parameters xmlns="http://hl7.org/fhir">`+
+			`<parameter><name value="expression"/><valueString value="1 = 1"/></parameter>`+
+			`<parameter><name value="resource"/><resource><CapabilityStatement>`+
+			`<status value="active"/><kind value="instance"/><fhirVersion value="5.0.0"/>`+
+			`</CapabilityStatement></resource></parameter>`+
+			`</Parameters>`)
+		release := findParam(findParam(got.Parameter, "parameters").Part, "detectedRelease")
+		if release == nil || *release.ValueString != "R5" {
+			t.Fatalf("expected R5 from the fhirVersion element, got %+v", release)
+		}
+	})
+
+	t.Run("nested and repeated unknown XML elements", func(t *testing.T) {
+		// Coding has no text, but CodeableConcept has; unknown elements may have children of their own
+		got := postXML(t, `<Parameters xmlns="http://hl7.org/fhir">`+
+			`<parameter><name value="expression"/><valueString value="name.given | maritalStatus.text"/></parameter>`+
+			`<parameter><name value="resource"/><resource><Patient>`+
+			`<name><given value="Alice"/><nickname value="Al"/></name>`+
+			`<name><given value="Bob"/><nickname><extension url="http://example.org/x"><valueString value="B"/></extension></nickname></name>`+
+			`<maritalStatus><coding><code value="M"/><text value="oops"/></coding><text value="Married"/></maritalStatus>`+
+			`</Patient></resource></parameter>`+
+			`</Parameters>`)
+		var values []string
+		for _, p := range findParam(got.Parameter, "result").Part {
+			values = append(values, *p.ValueString)
+		}
+		if strings.Join(values, " ") != "Alice Bob Married" {
+			t.Errorf("expected only the unknown elements dropped, got %v", values)
+		}
+		var warnings []string
+		if w := findParam(findParam(got.Parameter, "parameters").Part, "warnings"); w != nil {
+			for _, p := range w.Part {
+				warnings = append(warnings, *p.ValueString)
+			}
+		}
+		want := []string{
+			"element 'nickname' (Patient.name) is unknown in R4 and was ignored",
+			"element 'nickname' (Patient.name) is unknown in R4 and was ignored",
+			"element 'text' (Patient.maritalStatus.coding) is unknown in R4 and was ignored",
+		}
+		if !slices.Equal(warnings, want) {
+			t.Errorf("got warnings %v, want %v", warnings, want)
+		}
+	})
+
+	t.Run("fitting budget", func(t *testing.T) {
+		// Every unknown element costs a decoding attempt
+		patient := map[string]any{"resourceType": "Patient"}
+		var xmlPatient strings.Builder
+		for i := range maxFitDecodes {
+			patient[fmt.Sprintf("unknown%02d", i)] = "x"
+			fmt.Fprintf(&xmlPatient, `<unknown%02d value="x"/>`, i)
+		}
+		// Locating an unknown element probes every object holding a field of that name before it
+		contacts := make([]any, maxFitDecodes)
+		for i := range contacts {
+			contacts[i] = map[string]any{"name": map[string]any{"text": "Bob"}}
+		}
+		hidden := map[string]any{
+			"resourceType":  "Patient",
+			"contact":       contacts,
+			"maritalStatus": map[string]any{"coding": []any{map[string]any{"code": "M", "text": "oops"}}},
+		}
+		// Large resources are only decoded strictly
+		large := map[string]any{
+			"resourceType":    "Patient",
+			"name":            []any{map[string]any{"text": strings.Repeat("x", maxFitBytes)}},
+			"favouriteColour": "blue",
+		}
+
+		tests := []struct {
+			name, format, body, want string
+		}{
+			{name: "unknown elements", format: "application/fhir+json", body: jsonParameters(t, patient), want: "too many unknown elements"},
+			{name: "unlocatable element", format: "application/fhir+json", body: jsonParameters(t, hidden), want: "element 'text' (Coding) is unknown in R4 and could not be located"},
+			{name: "large resource", format: "application/fhir+json", body: jsonParameters(t, large), want: "too many unknown elements"},
+			{
+				name:   "unknown XML elements",
+				format: "application/fhir+xml",
+				body:   `<Parameters xmlns="http://hl7.org/fhir"><parameter><name value="resource"/><resource><Patient>` + xmlPatient.String() + `</Patient></resource></parameter></Parameters>`,
+				want:   "too many unknown elements",
+			},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := detectParameters([]byte(tc.body), tc.format, "")
+				if err == nil || !strings.Contains(err.Error(), "unable to determine FHIR release") || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("expected the release not to be determined because of %q, got %v", tc.want, err)
+				}
+			})
+		}
+	})
+
+	t.Run("fallback to R4", func(t *testing.T) {
+		plain := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
+		defer plain.Close()
+		got := postJSON(t, plain, "/$fhirpath-auto", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("1 = 1")},
+			{Name: "resource", Resource: map[string]any{"resourceType": "Patient"}},
+		}})
+		warnings := findParam(findParam(got.Parameter, "parameters").Part, "warnings")
+		if warnings == nil || len(warnings.Part) != 1 || *warnings.Part[0].ValueString != "FHIR release was not detected, evaluated as R4" {
+			t.Errorf("expected a fallback warning, got %+v", warnings)
+		}
+	})
+}
+
+// jsonParameters encodes Parameters holding the resource as JSON.
+func jsonParameters(t *testing.T, resource map[string]any) string {
+	t.Helper()
+	b, err := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{{Name: "resource", Resource: resource}}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(b)
+}
+
+func TestCompareReleases(t *testing.T) {
+	ts := httptest.NewServer(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}}))
+	defer ts.Close()
+
+	compare := func(expression string, resource map[string]any) parameters {
+		return postJSON(t, ts, "/$fhirpath-compare", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To(expression)},
+			{Name: "resource", Resource: resource},
+		}})
+	}
+
+	t.Run("same results", func(t *testing.T) {
+		got := compare("name.given", map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}})
+		releases := findParams(got.Parameter, "release")
+		if len(releases) != 3 {
+			t.Fatalf("expected 3 release params, got %+v", releases)
+		}
+		for i, want := range []string{"R4", "R4B", "R5"} {
+			if releases[i].ValueString == nil || *releases[i].ValueString != want {
+				t.Fatalf("release %d: got %+v, want %s", i, releases[i].ValueString, want)
+			}
+			result := findParam(releases[i].Part, "result")
+			if result == nil || len(result.Part) != 1 || result.Part[0].ValueString == nil || *result.Part[0].ValueString != "Alice" {
+				t.Fatalf("%s: unexpected result %+v", want, result)
+			}
+		}
+		if diff := findParam(got.Parameter, "diff"); diff == nil || len(diff.Part) != 0 {
+			t.Fatalf("expected an empty diff, got %+v", diff)
+		}
+	})
+
+	t.Run("R5-only element", func(t *testing.T) {
+		got := compare("Observation.triggeredBy.type", map[string]any{"resourceType": "Observation", "status": "final", "code": map[string]any{"text": "x"}, "triggeredBy": []any{map[string]any{"observation": map[string]any{"reference": "Observation/o1"}, "type": "reflex"}}})
+		releases := findParams(got.Parameter, "release")
+		if len(releases) != 3 {
+			t.Fatalf("expected 3 release params, got %+v", releases)
+		}
+		if findParam(releases[0].Part, "error") == nil || findParam(releases[2].Part, "result") == nil {
+			t.Fatalf("expected R4 to fail and R5 to succeed, got %+v", releases)
+		}
+		// Every pair of releases is compared, R4B and R5 included
+		diff := findParam(got.Parameter, "diff")
+		var pairs []string
+		for _, d := range diff.Part {
+			if d.ValueString == nil || *d.ValueString != "error" {
+				t.Fatalf("expected error differences, got %+v", d)
+			}
+			pairs = append(pairs, *findParam(d.Part, "base").ValueString+"-"+*findParam(d.Part, "release").ValueString)
+		}
+		if !slices.Contains(pairs, "R4-R5") || !slices.Contains(pairs, "R4B-R5") {
+			t.Fatalf("expected R4 and R4B to differ from R5, got %v", pairs)
+		}
+	})
+
+	t.Run("not representable in R4", func(t *testing.T) {
+		got := compare("1L | 'a' | 'Patient/x'.resolve()", map[string]any{"resourceType": "Patient"})
+		releases := findParams(got.Parameter, "release")
+		if findParam(releases[0].Part, "result") == nil {
+			t.Fatalf("expected an R4 result, got %+v", releases[0])
+		}
+		// The integer64 is converted to a decimal rather than left out
+		result := findParam(releases[2].Part, "result")
+		if result == nil || len(result.Part) != 2 || result.Part[0].ValueDecimal != "1" ||
+			result.Part[1].ValueString == nil || *result.Part[1].ValueString != "a" {
+			t.Fatalf("expected the R5 integer64 as decimal and the string result, got %+v", releases[2])
+		}
+		warnings := findParam(releases[2].Part, "warnings")
+		if warnings == nil || len(warnings.Part) != 2 ||
+			*warnings.Part[0].ValueString != "unable to resolve reference 'Patient/x'" ||
+			!strings.Contains(*warnings.Part[1].ValueString, "converted to R4 types") {
+			t.Fatalf("expected the evaluation and conversion warnings, got %+v", warnings)
+		}
+	})
+
+	t.Run("Long result", func(t *testing.T) {
+		got := compare("5L", map[string]any{"resourceType": "Patient"})
+		releases := findParams(got.Parameter, "release")
+		for i, release := range []string{"R4", "R4B", "R5"} {
+			result := findParam(releases[i].Part, "result")
+			if result == nil || len(result.Part) != 1 || result.Part[0].ValueDecimal != "5" ||
+				len(result.Part[0].Extension) != 1 || *result.Part[0].Extension[0].ValueString != "System.Long" {
+				t.Fatalf("%s: expected 5 as decimal typed System.Long, got %+v", release, result)
+			}
+		}
+		// R5 emits the Long as integer64, which the diff reports against R4 and R4B
+		diff := findParam(got.Parameter, "diff")
+		var pairs []string
+		for _, d := range diff.Part {
+			if d.ValueString == nil || *d.ValueString != "representation" {
+				t.Fatalf("expected representation differences, got %+v", d)
+			}
+			release := *findParam(d.Part, "release").ValueString
+			if r := findParam(d.Part, release); r == nil || *r.ValueString != "valueInteger64" {
+				t.Fatalf("expected the R5 representation, got %+v", d)
+			}
+			pairs = append(pairs, *findParam(d.Part, "base").ValueString+"-"+release)
+		}
+		if !slices.Equal(pairs, []string{"R4-R5", "R4B-R5"}) {
+			t.Fatalf("expected R4 and R4B to differ from R5, got %v", pairs)
+		}
+	})
+
+	t.Run("resource not representable in R4", func(t *testing.T) {
+		resource := `{"resourceType":"Observation","status":"final","code":{"text":"x"},"triggeredBy":[{"observation":{"reference":"Observation/o1"},"type":"reflex"}]}`
+		fitted, ok := fitR4Parameter(json.RawMessage(`{"name":"resource","resource":` + resource + `}`))
+		if !ok {
+			t.Fatal("expected the resource part to be kept")
+		}
+		var part param
+		if err := json.Unmarshal(fitted, &part); err != nil {
+			t.Fatal(err)
+		}
+		if part.Resource != nil || jsonValue(part) != resource {
+			t.Fatalf("expected the resource as json-value, got %s", fitted)
+		}
+	})
+}
+
+func TestPrimitiveExtensions(t *testing.T) {
+	ts := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
+	defer ts.Close()
+
+	dataAbsent := map[string]any{"url": "http://hl7.org/fhir/StructureDefinition/data-absent-reason", "valueCode": "masked"}
+	resource := map[string]any{
+		"resourceType": "Patient",
+		"text":         map[string]any{"status": "generated", "div": `<div xmlns="http://www.w3.org/1999/xhtml">Alice &amp; Bob</div>`},
+		"name": []any{map[string]any{
+			"given":  []any{"Alice", nil},
+			"_given": []any{map[string]any{"id": "g1"}, map[string]any{"extension": []any{dataAbsent}}},
+		}},
+	}
+	evaluate := func(expression string) []param {
+		got := postJSON(t, ts, "/$fhirpath", parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To(expression)},
+			{Name: "resource", Resource: resource},
+		}})
+		result := findParam(got.Parameter, "result")
+		if result == nil {
+			t.Fatalf("%s: missing result", expression)
+		}
+		return result.Part
+	}
+
+	given := evaluate("name.given")
+	if len(given) != 2 {
+		t.Fatalf("expected 2 given names, got %+v", given)
+	}
+	if given[0].ValueString == nil || *given[0].ValueString != "Alice" || given[0].ValueStringElement["id"] != "g1" {
+		t.Fatalf("expected Alice with id g1, got %+v", given[0])
+	}
+	exts, _ := given[1].ValueStringElement["extension"].([]any)
+	if given[1].ValueString != nil || len(exts) != 1 {
+		t.Fatalf("expected a value-less given with data-absent-reason, got %+v", given[1])
+	}
+
+	// Complex values keep their markup unescaped, as written by the FHIR encoder
+	narrative := evaluate("text")
+	if len(narrative) != 1 || !strings.Contains(jsonValue(narrative[0]), `"div":"<div xmlns=\"http://www.w3.org/1999/xhtml\">Alice &amp; Bob</div>"`) {
+		t.Fatalf("unexpected narrative %+v", narrative)
+	}
+}
+
+func TestSystemTypes(t *testing.T) {
+	ts := httptest.NewServer(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}}))
+	defer ts.Close()
+
+	tests := []struct {
+		path       string
+		expression string
+		// want is the expected part (without name and extension), empty to check the type only
+		want string
+		typ  string
+	}{
+		{"/$fhirpath", "true", `{"valueBoolean":true}`, "System.Boolean"},
+		{"/$fhirpath", "'a'", `{"valueString":"a"}`, "System.String"},
+		{"/$fhirpath", "1.50", `{"valueDecimal":1.50}`, "System.Decimal"},
+		{"/$fhirpath", "1L", `{"valueDecimal":1}`, "System.Long"},
+		{"/$fhirpath-r5", "1L", `{"valueInteger64":"1"}`, "System.Long"},
+		{"/$fhirpath", "@2020-01", `{"valueDate":"2020-01"}`, "System.Date"},
+		{"/$fhirpath", "@2020-01-01T10", `{"valueDateTime":"2020-01-01T10"}`, "System.DateTime"},
+		{"/$fhirpath", "@2020-01-01T10:30", `{"valueDateTime":"2020-01-01T10:30"}`, "System.DateTime"},
+		{"/$fhirpath", "@2020-01-01T10:00:00.123+02:00", `{"valueDateTime":"2020-01-01T10:00:00.123+02:00"}`, "System.DateTime"},
+		{"/$fhirpath", "@T10:30:00.5", `{"valueTime":"10:30:00.500"}`, "System.Time"},
+		{"/$fhirpath", "1.50 'mg'", `{"valueQuantity":{"value":1.50,"unit":"mg","system":"http://unitsofmeasure.org","code":"mg"}}`, "System.Quantity"},
+		{"/$fhirpath", "2 years", `{"valueQuantity":{"value":2,"unit":"years"}}`, "System.Quantity"},
+		{"/$fhirpath", "Patient.name.given", `{"valueString":"Alice"}`, "FHIR.string"},
+		{"/$fhirpath", "Patient.name", ``, "FHIR.HumanName"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path+" "+tc.expression, func(t *testing.T) {
+			body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(tc.expression)},
+				{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}},
+			}})
+			resp, err := http.Post(ts.URL+tc.path, "application/fhir+json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			var got struct {
+				Parameter []struct {
+					Name string                       `json:"name"`
+					Part []map[string]json.RawMessage `json:"part"`
+				} `json:"parameter"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(got.Parameter) == 0 || got.Parameter[0].Name != "result" || len(got.Parameter[0].Part) != 1 {
+				t.Fatalf("expected a single result, got %+v", got)
+			}
+			part := got.Parameter[0].Part[0]
+
+			var exts []struct {
+				Url         string `json:"url"`
+				ValueString string `json:"valueString"`
+			}
+			json.Unmarshal(part["extension"], &exts)
+			if len(exts) == 0 || exts[len(exts)-1].Url != typeExtensionURL || exts[len(exts)-1].ValueString != tc.typ {
+				t.Fatalf("expected type %s, got %s", tc.typ, part["extension"])
+			}
+			if tc.want == "" {
+				return
+			}
+
+			delete(part, "name")
+			delete(part, "extension")
+			value, _ := json.Marshal(part)
+			if string(value) != tc.want {
+				t.Fatalf("got %s, want %s", value, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCache(t *testing.T) {
+	cache := NewParseCache(2, 0)
+	ts := httptest.NewServer(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: "", ParseCache: cache}}))
+	defer ts.Close()
+
+	evaluate := func(path, expression, context string) {
+		t.Helper()
+		ps := []param{
+			{Name: "expression", ValueString: ptr.To(expression)},
+			{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}},
+		}
+		if context != "" {
+			ps = append(ps, param{Name: "context", ValueString: ptr.To(context)})
+		}
+		got := postJSON(t, ts, path, parameters{ResourceType: "Parameters", Parameter: ps})
+		if findParam(got.Parameter, "result") == nil {
+			t.Fatalf("%s: missing result", expression)
+		}
+	}
+
+	evaluate("/$fhirpath", "given", "name")
+	evaluate("/$fhirpath", "given", "name")
+	if s := cache.Stats(); s.Hits != 2 || s.Misses != 2 || s.Len != 2 {
+		t.Fatalf("expected 2 hits and 2 misses, got %+v", s)
+	}
+
+	// Entries are per release, the least recently used one is evicted
+	evaluate("/$fhirpath-r5", "given", "")
+	if s := cache.Stats(); s.Misses != 3 || s.Evictions != 1 || s.Len != 2 {
+		t.Fatalf("expected a miss and an eviction, got %+v", s)
+	}
+	evaluate("/$fhirpath", "name", "")
+	if s := cache.Stats(); s.Hits != 3 {
+		t.Fatalf("expected the more recently used R4 context to be kept, got %+v", s)
+	}
+
+	// The total length of the expressions is bounded as well, longer expressions are not cached
+	cache = NewParseCache(10, 20)
+	for _, expression := range []string{"name.given", "name.family", "name.given"} {
+		cache.Parse("R4", expression)
+	}
+	if s := cache.Stats(); s.Len != 1 || s.Bytes != 10 || s.Evictions != 2 || s.Hits != 0 {
+		t.Fatalf("expected the least recently used expressions to be evicted over 20 bytes, got %+v", s)
+	}
+	long := "name.where(given = 'a very long name')"
+	cache.Parse("R4", long)
+	cache.Parse("R4", long)
+	if s := cache.Stats(); s.Len != 1 || s.Bytes != 10 || s.Misses != 5 {
+		t.Fatalf("expected expressions over the bound not to be cached, got %+v", s)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	backend := &Backend{BaseURL: "", ParseCache: NewParseCache(8, 0)}
+	metrics := NewMetrics()
+	metrics.ParseCache = backend.ParseCache
+	ts := httptest.NewServer(metrics.Instrument(ReleaseParameters(&rest.Server[model.R4]{Backend: backend})))
+	defer ts.Close()
+
+	patient := map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice", "Bob"}}}}
+	postJSON(t, ts, "/$fhirpath-r5", parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("name.given")},
+		{Name: "resource", Resource: patient},
+	}})
+	body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("name.given.where(")},
+		{Name: "resource", Resource: patient},
+	}})
+	resp, err := http.Post(ts.URL+"/$fhirpath", "application/fhir+json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	failedStatus := resp.StatusCode
+
+	// Unknown operations share a single series
+	for _, path := range []string{"/$random-1", "/$random-2"} {
+		resp, err := http.Post(ts.URL+path, "application/fhir+json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exposition := rec.Body.String()
+	if strings.Contains(exposition, "random") {
+		t.Errorf("expected unknown operations reported as other, got\n%s", exposition)
+	}
+
+	for _, want := range []string{
+		`fhirpath_lab_requests_total{operation="fhirpath-r5",release="R5",code="200"} 1`,
+		`fhirpath_lab_requests_total{operation="fhirpath",release="R4",code="` + strconv.Itoa(failedStatus) + `"} 1`,
+		`fhirpath_lab_request_duration_seconds_count{operation="fhirpath-r5",release="R5"} 1`,
+		`fhirpath_lab_parse_duration_seconds_count{release="R5"} 1`,
+		`fhirpath_lab_evaluation_duration_seconds_count{release="R5"} 1`,
+		`fhirpath_lab_errors_total{operation="fhirpath",class="parse"} 1`,
+		`fhirpath_lab_result_size_bucket{operation="fhirpath-r5",le="1"} 0`,
+		`fhirpath_lab_result_size_bucket{operation="fhirpath-r5",le="2"} 1`,
+		`fhirpath_lab_result_size_sum{operation="fhirpath-r5"} 2`,
+		`fhirpath_lab_requests_total{operation="other",release="",code="400"} 2`,
+		"fhirpath_lab_evaluations_in_flight 0",
+		"fhirpath_lab_parse_cache_misses_total 2",
+		"# TYPE fhirpath_lab_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("missing %q in\n%s", want, exposition)
+		}
+	}
+
+	t.Run("in flight", func(t *testing.T) {
+		metrics := NewMetrics()
+		started, release := make(chan struct{}), make(chan struct{})
+		handler := metrics.Instrument(Throttle(ThrottleConfig{MaxConcurrent: 1})(metrics.CountInFlight(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			}))))
+		done := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/$fhirpath", nil))
+			close(done)
+		}()
+		<-started
+
+		// Rejected by the throttle, so never evaluated
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/$fhirpath", nil))
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", rec.Code)
+		}
+		if n := metrics.inFlight.Load(); n != 1 {
+			t.Errorf("expected 1 evaluation in flight, got %d", n)
+		}
+		close(release)
+		<-done
+	})
+
+	t.Run("errors of successful requests", func(t *testing.T) {
+		// $fhirpath-compare reports the failure of a single release, but the request succeeds
+		metrics := NewMetrics()
+		handler := metrics.Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestInfoFrom(r.Context()).errorClass = "evaluation"
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/$fhirpath-compare", nil))
+		rec := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if strings.Contains(rec.Body.String(), "fhirpath_lab_errors_total{") {
+			t.Errorf("expected no errors counted, got\n%s", rec.Body.String())
+		}
+	})
+}
+
+func TestRequestLogging(t *testing.T) {
+	patient := map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}
+	evaluate := func(config LogConfig, requestID string) (map[string]any, *http.Response) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		ts := httptest.NewServer(RequestLogger(logger, config)(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})))
+		defer ts.Close()
+
+		body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+			{Name: "expression", ValueString: ptr.To("name.given")},
+			{Name: "resource", Resource: patient},
+		}})
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath-r4b", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/fhir+json")
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("expected a single JSON record, got %q: %v", buf.String(), err)
+		}
+		return record, resp
+	}
+
+	record, resp := evaluate(LogConfig{Expressions: true}, "abc-123")
+	if record["request_id"] != "abc-123" || resp.Header.Get("X-Request-ID") != "abc-123" {
+		t.Fatalf("expected the client request ID, got %v / %q", record["request_id"], resp.Header.Get("X-Request-ID"))
+	}
+	for key, want := range map[string]any{
+		"operation":       "fhirpath-r4b",
+		"release":         "R4B",
+		"expression":      "name.given",
+		"expression_hash": expressionHash("name.given"),
+		"outcome":         "success",
+		"status":          float64(200),
+	} {
+		if record[key] != want {
+			t.Errorf("%s: got %v, want %v", key, record[key], want)
+		}
+	}
+	if _, ok := record["duration_ms"].(float64); !ok {
+		t.Errorf("missing duration_ms in %v", record)
+	}
+	if _, ok := record["resource"]; ok {
+		t.Errorf("resource logged although not enabled: %v", record)
+	}
+
+	// Redacted expression, generated request ID
+	record, resp = evaluate(LogConfig{Resources: true}, "")
+	if id, _ := record["request_id"].(string); id == "" || id != resp.Header.Get("X-Request-ID") {
+		t.Fatalf("expected a generated request ID, got %v", record["request_id"])
+	}
+	if _, ok := record["expression"]; ok || record["expression_hash"] == nil {
+		t.Errorf("expected only the expression hash, got %v", record)
+	}
+	if res, _ := record["resource"].(string); !strings.Contains(res, "Alice") {
+		t.Errorf("expected the resource, got %v", record["resource"])
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	get := func(h http.Handler) (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return rec.Code, body
+	}
+
+	if code, body := get(HealthHandler()); code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("healthz: %d %v", code, body)
+	}
+
+	readiness := ReadinessHandler()
+	code, body := get(readiness)
+	if code != http.StatusOK || body["status"] != "ready" {
+		t.Fatalf("readyz: %d %v", code, body)
+	}
+	if code, again := get(readiness); code != http.StatusOK || !reflect.DeepEqual(again, body) {
+		t.Errorf("cached readyz: %d %v", code, again)
+	}
+	releases, _ := body["releases"].(map[string]any)
+	for _, release := range []string{"R4", "R4B", "R5"} {
+		if releases[release] != "ok" {
+			t.Errorf("readyz %s: %v", release, releases[release])
+		}
+	}
+
+	if code, body := get(VersionHandler()); code != http.StatusOK || body["version"] == "" || body["goVersion"] == "" {
+		t.Fatalf("version: %d %v", code, body)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	ts := httptest.NewServer(MaxBodySize(64)(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})))
+	defer ts.Close()
+
+	body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("name.given")},
+		{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}},
+	}})
+	for name, reader := range map[string]io.Reader{
+		"declared length": bytes.NewReader(body),
+		// wrapping hides the length, so the body is sent chunked
+		"chunked": io.MultiReader(bytes.NewReader(body)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL+"/$fhirpath-r5", "application/fhir+json", reader)
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("expected 413, got %d", resp.StatusCode)
+			}
+			var outcome struct {
+				ResourceType string `json:"resourceType"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&outcome); err != nil || outcome.ResourceType != "OperationOutcome" {
+				t.Fatalf("expected an OperationOutcome, got %+v (%v)", outcome, err)
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	config := DefaultCORSConfig()
+	config.AllowedOrigins = []string{"https://lab.example.org", "https://*.example.com"}
+	config.AllowCredentials = true
+	handler := CORS(config)(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})
+
+	tests := []struct {
+		origin string
+		method string
+		want   string
+	}{
+		{"https://lab.example.org", http.MethodGet, "https://lab.example.org"},
+		{"https://fhirpath.example.com", http.MethodOptions, "https://fhirpath.example.com"},
+		{"https://a.b.example.com", http.MethodGet, "https://a.b.example.com"},
+		{"https://example.com", http.MethodGet, ""},
+		{"http://fhirpath.example.com", http.MethodGet, ""},
+		{"https://evil-example.com", http.MethodGet, ""},
+		{"https://fhirpath-lab.com", http.MethodGet, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.origin, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/metadata", nil)
+			req.Header.Set("Origin", tc.origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			h := rec.Header()
+			if got := h.Get("Access-Control-Allow-Origin"); got != tc.want {
+				t.Fatalf("Allow-Origin: got %q, want %q", got, tc.want)
+			}
+			if tc.want == "" {
+				return
+			}
+			if h.Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("expected credentials to be allowed")
+			}
+			if tc.method == http.MethodOptions {
+				if rec.Code != http.StatusNoContent || !strings.Contains(h.Get("Access-Control-Allow-Methods"), "GET") || h.Get("Access-Control-Max-Age") != "600" {
+					t.Errorf("unexpected preflight response %d %v", rec.Code, h)
+				}
+			} else if rec.Code != http.StatusOK {
+				t.Errorf("expected metadata, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	load := func(args []string, env map[string]string) (Config, error) {
+		lookup := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+		return LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args, lookup)
+	}
+
+	yamlFile := write("config.yaml", "addr: :4000\nparseCache: 10\nserver:\n  writeTimeout: 5s\n  readTimeout: 7\ncors:\n  allowedOrigins: [\"https://*.example.org\"]\nlog:\n  expressions: true\n")
+	config, err := load([]string{"-config", yamlFile, "-parse-cache", "20", "-log-resources"}, map[string]string{
+		"FHIRPATH_LAB_PARSE_CACHE":  "15",
+		"FHIRPATH_LAB_IDLE_TIMEOUT": "1m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Addr != ":4000" || config.ParseCache != 20 || !config.Log.Resources || !config.Log.Expressions {
+		t.Errorf("unexpected layering: %+v", config)
+	}
+	if config.Server.WriteTimeout != Duration(5*time.Second) || config.Server.ReadTimeout != Duration(7*time.Second) || config.Server.IdleTimeout != Duration(time.Minute) {
+		t.Errorf("unexpected timeouts: %+v", config.Server)
+	}
+	if len(config.CORS.AllowedOrigins) != 1 || len(config.CORS.AllowedMethods) != 3 {
+		t.Errorf("expected the file origins and default methods, got %+v", config.CORS)
+	}
+
+	tomlFile := write("config.toml", "addr = \"127.0.0.1:5000\"\n[log]\nexpressions = false\n")
+	config, err = load([]string{}, map[string]string{"FHIRPATH_LAB_CONFIG": tomlFile, "PORT": "6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Addr != ":6000" || config.Log.Expressions {
+		t.Errorf("unexpected TOML config: %+v", config)
+	}
+	if config.Throttle.MaxConcurrent <= 0 {
+		t.Errorf("expected evaluations to be capped by default, got %+v", config.Throttle)
+	}
+
+	config, err = load([]string{}, map[string]string{"FHIRPATH_LAB_AUTH_API_KEYS": "lab=k1, ci=k2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Auth.Keys) != 2 || config.Auth.Keys[1] != (APIKey{Name: "ci", Key: "k2"}) {
+		t.Errorf("unexpected auth config: %+v", config.Auth)
+	}
+	if printed, _ := json.Marshal(config); strings.Contains(string(printed), "k2") {
+		t.Errorf("expected API keys to be redacted, got %s", printed)
+	}
+	config, err = load([]string{"-config", write("keys.yaml", "auth:\n  keys:\n    - {name: batch, key: k3, rateLimit: {rate: 5, burst: 20}}\n")}, nil)
+	if err != nil || config.Auth.Keys[0].RateLimit == nil || *config.Auth.Keys[0].RateLimit != (RateLimit{Rate: 5, Burst: 20}) {
+		t.Errorf("expected the key's rate limit, got %+v %v", config.Auth, err)
+	}
+	if _, err := load([]string{"-config", write("keys.json", `{"auth": {"keys": [{"name": "batch", "key": "k3", "rateLimit": {"rate": -1}}]}}`)}, nil); err == nil || !strings.Contains(err.Error(), "auth.keys[0].rateLimit") {
+		t.Errorf("expected the key's rate limit to be validated, got %v", err)
+	}
+	if config.Mode != ModeServe {
+		t.Errorf("expected to serve by default, got %q", config.Mode)
+	}
+
+	if config, err := load([]string{"-check-config"}, nil); err != nil || config.Mode != ModeCheckConfig {
+		t.Errorf("expected the check-config mode, got %q %v", config.Mode, err)
+	}
+	if config, err := load([]string{"-print-config=false"}, nil); err != nil || config.Mode != ModeServe {
+		t.Errorf("expected to serve, got %q %v", config.Mode, err)
+	}
+	if _, err := load([]string{"-print-config", "-check-config"}, nil); err == nil {
+		t.Errorf("expected modes to be exclusive")
+	}
+
+	if _, err := load([]string{"-config", write("bad.json", `{"addr": ":1", "unknown": true}`)}, nil); err == nil {
+		t.Errorf("expected unknown fields to be rejected")
+	}
+	_, err = load([]string{"-parse-cache", "-1", "-cors-origins", "example.org", "-cors-methods", ""}, nil)
+	if err == nil || !strings.Contains(err.Error(), "parseCache") || !strings.Contains(err.Error(), "cors origin") || !strings.Contains(err.Error(), "allowedMethods") {
+		t.Errorf("expected all validation errors, got %v", err)
+	}
+	if _, err := load([]string{"-cors-origins", "*", "-cors-credentials"}, nil); err == nil || !strings.Contains(err.Error(), "allowCredentials") {
+		t.Errorf("expected any origin with credentials to be rejected, got %v", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	caFile := writePEM("ca.pem", "CERTIFICATE", caDER)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	// issue signs a leaf certificate with the CA
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+		key := newKey()
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	writePair := func(c tls.Certificate) (string, string) {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writePEM("server.pem", "CERTIFICATE", c.Certificate[0]), writePEM("server-key.pem", "PRIVATE KEY", keyDER)
+	}
+
+	certFile, keyFile := writePair(issue(2, "server 1", x509.ExtKeyUsageServerAuth))
+	config := TLSConfig{Cert: certFile, Key: keyFile, ClientCA: caFile, ClientAuth: "require"}
+	if errs := config.validate(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldInterval := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = oldInterval }()
+
+	// httptest.Server would install its own certificate, serve like main does instead
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+		}),
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+	}
+	if _, err := client().Get(url); err == nil {
+		t.Errorf("expected a client without certificate to be rejected")
+	}
+	get := func() (*http.Response, string) {
+		resp, err := client(issue(3, "internal caller", x509.ExtKeyUsageClientAuth)).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	resp, body := get()
+	if resp.ProtoMajor != 2 || body != "internal caller" {
+		t.Errorf("expected HTTP/2 with the client certificate, got %s %q", resp.Proto, body)
+	}
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "server 1" {
+		t.Errorf("unexpected server certificate %q", cn)
+	}
+
+	// Renewed certificates are served without a restart
+	writePair(issue(4, "server 2", x509.ExtKeyUsageServerAuth))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	resp, _ = get()
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "server 2" {
+		t.Errorf("expected the reloaded certificate, got %q", cn)
+	}
+
+	// A broken file keeps the previous certificate
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	resp, _ = get()
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "server 2" {
+		t.Errorf("expected the previous certificate after a failed reload, got %q", cn)
+	}
+
+	if errs := (TLSConfig{Cert: certFile, ClientAuth: "always"}).validate(); len(errs) != 2 {
+		t.Errorf("expected missing key and invalid clientAuth errors, got %v", errs)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []any{map[string]any{
+		"kty": "EC", "kid": "k1", "crv": "P-256", "use": "sig",
+		"x": base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+	}}})
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, jwks, 0o644)
+
+	// token builds a compact JWS, sign computes the signature of the signing input
+	token := func(alg string, claims map[string]any, sign func([]byte) []byte) string {
+		header, _ := json.Marshal(map[string]any{"alg": alg, "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+	}
+	hs256 := func(secret string) func([]byte) []byte {
+		return func(b []byte) []byte {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(b)
+			return mac.Sum(nil)
+		}
+	}
+	es256 := func(b []byte) []byte {
+		digest := sha256.Sum256(b)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	authenticators, err := NewAuthenticators(AuthConfig{
+		Keys: []APIKey{
+			{Name: "lab", Key: "secret-key"},
+			{Name: "ci", Key: "ci-key", RateLimit: &RateLimit{Rate: 0.001, Burst: 2}},
+		},
+		HMACSecret: "shared",
+		JWKS:       jwksFile,
+		Audience:   "fhirpath-lab",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	// All clients share the test's address, only failed authentications are charged to it
+	throttler := NewThrottler(ThrottleConfig{PerClient: RateLimit{Rate: 0.001, Burst: 20}})
+	ts := httptest.NewServer(RequestLogger(logger, LogConfig{})(throttler.Addresses(Authenticate(authenticators...)(
+		throttler.Principals(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}}))))))
+	defer ts.Close()
+
+	body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("name.given")},
+		{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}},
+	}})
+	post := func(header, value string) *http.Response {
+		logs.Reset()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath-r4", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/fhir+json")
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	principal := func() any {
+		var record map[string]any
+		json.Unmarshal(logs.Bytes(), &record)
+		return record["principal"]
+	}
+
+	for name, tc := range map[string]struct {
+		header, value string
+		principal     string
+	}{
+		"api key header": {"X-API-Key", "secret-key", "api-key:lab"},
+		"api key bearer": {"Authorization", "Bearer secret-key", "api-key:lab"},
+		"hmac token":     {"Authorization", "Bearer " + token("HS256", map[string]any{"sub": "alice", "aud": "fhirpath-lab", "exp": exp}, hs256("shared")), "hmac:alice"},
+		"jwks token":     {"Authorization", "Bearer " + token("ES256", map[string]any{"sub": "svc", "aud": []string{"other", "fhirpath-lab"}, "exp": exp}, es256), "jwt:svc"},
+	} {
+		if resp := post(tc.header, tc.value); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", name, resp.StatusCode)
+		}
+		if got := principal(); got != tc.principal {
+			t.Errorf("%s: expected principal %q logged, got %v", name, tc.principal, got)
+		}
+	}
+
+	for name, tc := range map[string]struct{ header, value string }{
+		"missing":       {"", ""},
+		"unknown key":   {"X-API-Key", "nope"},
+		"wrong secret":  {"Authorization", "Bearer " + token("HS256", map[string]any{"sub": "alice", "aud": "fhirpath-lab"}, hs256("guess"))},
+		"expired":       {"Authorization", "Bearer " + token("HS256", map[string]any{"sub": "alice", "aud": "fhirpath-lab", "exp": time.Now().Add(-time.Hour).Unix()}, hs256("shared"))},
+		"no expiry":     {"Authorization", "Bearer " + token("HS256", map[string]any{"sub": "alice", "aud": "fhirpath-lab"}, hs256("shared"))},
+		"wrong aud":     {"Authorization", "Bearer " + token("ES256", map[string]any{"sub": "svc", "aud": "other"}, es256)},
+		"alg none":      {"Authorization", "Bearer " + token("none", map[string]any{"sub": "svc", "aud": "fhirpath-lab"}, func([]byte) []byte { return nil })},
+		"hmac with key": {"Authorization", "Bearer " + token("HS256", map[string]any{"sub": "svc", "aud": "fhirpath-lab"}, hs256(string(jwks)))},
+	} {
+		resp := post(tc.header, tc.value)
+		if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: expected 401 with a challenge, got %d", name, resp.StatusCode)
+		}
+	}
+
+	// Per-key rate limit, authenticated requests are charged to their principal only
+	for i := range 2 {
+		if resp := post("X-API-Key", "ci-key"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within the burst: got %d", i, resp.StatusCode)
+		}
+	}
+	resp := post("X-API-Key", "ci-key")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	// lab spent two of its 20 requests above
+	for i := range 18 {
+		if resp := post("X-API-Key", "secret-key"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected keys without a limit of their own to get throttle.perClient, request %d got %d", i, resp.StatusCode)
+		}
+	}
+	if resp := post("X-API-Key", "secret-key"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past throttle.perClient, got %d", resp.StatusCode)
+	}
+
+	// Failed authentications are limited by address before the credentials are checked
+	limited := false
+	for range 20 {
+		resp := post("X-API-Key", "guess")
+		if resp.StatusCode == http.StatusTooManyRequests {
+			limited = resp.Header.Get("Retry-After") != ""
+			break
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 before the limit, got %d", resp.StatusCode)
+		}
+	}
+	if !limited {
+		t.Error("expected repeated 401s to be rate limited with Retry-After")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	t.Run("per client", func(t *testing.T) {
+		handler := Throttle(ThrottleConfig{PerClient: RateLimit{Rate: 0.001, Burst: 2}, ClientIPHeader: "X-Forwarded-For"})(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		get := func(forwardedFor string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/metadata", nil)
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+		for range 2 {
+			if rec := get("10.0.0.1"); rec.Code != http.StatusOK {
+				t.Fatalf("expected the burst to pass, got %d", rec.Code)
+			}
+		}
+		// The address added by the proxy counts, not the one claimed by the client
+		rec := get("10.9.9.9, 10.0.0.1")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), "OperationOutcome") {
+			t.Errorf("expected 429 with Retry-After and an OperationOutcome, got %d %q", rec.Code, rec.Body.String())
+		}
+		if retry, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retry < 900 {
+			t.Errorf("expected to retry once a token refilled, got %d", retry)
+		}
+		if rec := get("10.0.0.2"); rec.Code != http.StatusOK {
+			t.Errorf("expected other clients not to be limited, got %d", rec.Code)
+		}
+	})
+
+	t.Run("default behind a proxy", func(t *testing.T) {
+		// Every request comes from the proxy's address, but the clients are distinct
+		get := func(handler http.Handler, client string) int {
+			req := httptest.NewRequest(http.MethodGet, "/metadata", nil)
+			req.RemoteAddr = "172.16.0.1:4000"
+			req.Header.Set("Fly-Client-IP", client)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		config := DefaultConfig().Throttle
+		handler := Throttle(config)(ok)
+		for i := range 100 {
+			if code := get(handler, "10.0.0."+strconv.Itoa(i)); code != http.StatusOK {
+				t.Fatalf("request %d: expected clients not to share the proxy's bucket, got %d", i, code)
+			}
+		}
+
+		config.ClientIPHeader, config.PerClient.Rate = "Fly-Client-IP", 5
+		handler = Throttle(config)(ok)
+		for i := range config.PerClient.Burst {
+			if code := get(handler, "10.0.0.1"); code != http.StatusOK {
+				t.Fatalf("request %d: expected the burst to pass, got %d", i, code)
+			}
+		}
+		if code := get(handler, "10.0.0.1"); code != http.StatusTooManyRequests {
+			t.Errorf("expected the client to be limited, got %d", code)
+		}
+		if code := get(handler, "10.0.0.2"); code != http.StatusOK {
+			t.Errorf("expected other clients behind the proxy not to be limited, got %d", code)
+		}
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		handler := Throttle(ThrottleConfig{MaxConcurrent: 1, MaxQueue: 1, QueueTimeout: Duration(time.Minute)})(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			}))
+		evaluate := func() chan int {
+			code := make(chan int, 1)
+			go func() {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/$fhirpath", nil))
+				code <- rec.Code
+			}()
+			return code
+		}
+
+		first := evaluate()
+		<-started
+		// One of them waits in the queue, the other finds it full
+		second, third := evaluate(), evaluate()
+		var queued chan int
+		select {
+		case code := <-second:
+			queued = third
+			if code != http.StatusTooManyRequests {
+				t.Errorf("expected 429 with a full queue, got %d", code)
+			}
+		case code := <-third:
+			queued = second
+			if code != http.StatusTooManyRequests {
+				t.Errorf("expected 429 with a full queue, got %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a full queue to be rejected")
+		}
+
+		// Non-evaluations are not capped
+		rec := httptest.NewRecorder()
+		Throttle(ThrottleConfig{MaxConcurrent: 1})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metadata", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected metadata to pass, got %d", rec.Code)
+		}
+
+		release <- struct{}{}
+		<-started
+		release <- struct{}{}
+		if code := <-first; code != http.StatusOK {
+			t.Errorf("first: got %d", code)
+		}
+		if code := <-queued; code != http.StatusOK {
+			t.Errorf("queued: got %d", code)
+		}
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		handler := Throttle(ThrottleConfig{MaxConcurrent: 1, MaxQueue: 5, QueueTimeout: Duration(10 * time.Millisecond)})(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+			}))
+		go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/$fhirpath", nil))
+		defer close(release)
+		<-started
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/$fhirpath", nil))
+		if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "timed out") {
+			t.Errorf("expected waiting for a slot to time out, got %d %q", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestResponseCache(t *testing.T) {
+	dir := t.TempDir()
+	var info *requestInfo
+	newServer := func() (*ResponseCache, *ParseCache, *httptest.Server) {
+		cache, err := NewResponseCache(ResponseCacheConfig{Size: 2, TTL: Duration(time.Minute), Dir: dir, DiskSize: 10})
+		if err != nil {
+			t.Fatalf("new cache: %v", err)
+		}
+		parseCache := NewParseCache(8, 0)
+		handler := NegotiateFormat(cache.Cache(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: "", ParseCache: parseCache}})))
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ctx context.Context
+			ctx, info = withRequestInfo(r.Context())
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		}))
+		return cache, parseCache, ts
+	}
+	cache, parseCache, ts := newServer()
+	defer ts.Close()
+
+	post := func(ts *httptest.Server, body string, header ...string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/fhir+json")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	body := `{"resourceType":"Parameters","parameter":[{"name":"expression","valueString":"name.given"},{"name":"resource","resource":{"resourceType":"Patient","name":[{"given":["Alice"]}]}}]}`
+	first, firstBody := post(ts, body)
+	if first.Header.Get("X-Cache") != "MISS" || first.Header.Get("ETag") == "" || !strings.Contains(firstBody, "Alice") {
+		t.Fatalf("expected an evaluated response with ETag, got %v %s", first.Header, firstBody)
+	}
+
+	// Whitespace and member order don't change the key
+	reordered := `{ "parameter": [{"valueString": "name.given", "name": "expression"}, {"name": "resource", "resource": {"name": [{"given": ["Alice"]}], "resourceType": "Patient"}}], "resourceType": "Parameters" }`
+	second, secondBody := post(ts, reordered)
+	if second.Header.Get("X-Cache") != "HIT" || secondBody != firstBody || second.Header.Get("ETag") != first.Header.Get("ETag") {
+		t.Errorf("expected the cached response, got %v %s", second.Header, secondBody)
+	}
+	if s := parseCache.Stats(); s.Hits+s.Misses != 1 {
+		t.Errorf("expected a single evaluation, got %+v", s)
+	}
+	if !info.cached || info.expression != "name.given" || info.results != 1 || info.release != "R4" {
+		t.Errorf("expected the cache hit to be reported, got %+v", info)
+	}
+
+	// Operations are POST requests, a matching If-None-Match fails the precondition instead of a 304
+	for _, tag := range []string{first.Header.Get("ETag"), "W/" + first.Header.Get("ETag"), `"other", ` + first.Header.Get("ETag"), "*"} {
+		if resp, got := post(ts, body, "If-None-Match", tag); resp.StatusCode != http.StatusPreconditionFailed || strings.Contains(got, "Alice") {
+			t.Errorf("expected 412 without the response for If-None-Match %s, got %d %s", tag, resp.StatusCode, got)
+		}
+	}
+	if resp, got := post(ts, body, "If-None-Match", `"other"`); resp.StatusCode != http.StatusOK || got != firstBody {
+		t.Errorf("expected 200 with the response for a different If-None-Match, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := post(ts, body, "Cache-Control", "no-cache"); resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("expected no-cache to evaluate again, got X-Cache %q", resp.Header.Get("X-Cache"))
+	}
+	if s := parseCache.Stats(); s.Hits+s.Misses != 2 {
+		t.Errorf("expected a second evaluation, got %+v", s)
+	}
+
+	// Traces and the time of evaluation are always evaluated
+	for _, expression := range []string{"name.trace('n').given", "now() > @2020", "today()", "timeOfDay().exists()"} {
+		uncached := strings.Replace(body, "name.given", expression, 1)
+		for range 2 {
+			if resp, _ := post(ts, uncached); resp.Header.Get("X-Cache") != "" {
+				t.Errorf("%s: expected the request to bypass the cache, got X-Cache %q", expression, resp.Header.Get("X-Cache"))
+			}
+		}
+	}
+
+	// Errors are not cached
+	invalid := strings.Replace(body, "name.given", "name.given.where(", 1)
+	post(ts, invalid)
+	if resp, _ := post(ts, invalid); resp.StatusCode == http.StatusOK || resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("expected failed evaluations not to be cached, got %d %q", resp.StatusCode, resp.Header.Get("X-Cache"))
+	}
+
+	// Expired responses are evaluated again
+	cache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if resp, _ := post(ts, body); resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("expected an expired response to be evaluated again, got %q", resp.Header.Get("X-Cache"))
+	}
+	if s := cache.Stats(); s.Hits != 6 || s.Len != 1 {
+		t.Errorf("expected 6 hits and 1 entry, got %+v", s)
+	}
+
+	// Responses on disk survive a restart
+	_, restartedParseCache, restarted := newServer()
+	defer restarted.Close()
+	if resp, got := post(restarted, body); resp.Header.Get("X-Cache") != "HIT" || got != firstBody {
+		t.Errorf("expected the response from disk, got %q", resp.Header.Get("X-Cache"))
+	}
+	if s := restartedParseCache.Stats(); s.Misses != 0 {
+		t.Errorf("expected no evaluation after the restart, got %+v", s)
+	}
+
+	// Freshly evaluated responses are returned in full, the precondition only fails for hits
+	fresh := strings.Replace(body, "name.given", "name.given.first()", 1)
+	resp, got := post(restarted, fresh, "If-None-Match", "*")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cache") != "MISS" || !strings.Contains(got, "Alice") {
+		t.Errorf("expected 200 with the evaluated response, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp, _ := post(restarted, fresh, "If-None-Match", resp.Header.Get("ETag")); resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get("X-Cache") != "HIT" {
+		t.Errorf("expected 412 once the response is cached, got %d %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ts := httptest.NewServer(Compress(CompressionConfig{Enabled: true, MinSize: 512, Level: -1})(
+		MaxBodySize(4096)(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}}))))
+	defer ts.Close()
+
+	post := func(body []byte, contentEncoding, acceptEncoding string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/$fhirpath-r5", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/fhir+json")
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		// Setting Accept-Encoding keeps the client from decompressing transparently
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("name.given")},
+		{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}, "family": strings.Repeat("Smith", 100)}}}},
+	}})
+
+	resp, b := post(gzipped(body), "gzip", "deflate;q=0.5, gzip")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip response, got %d %v", resp.StatusCode, resp.Header)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	var got parameters
+	if err := json.NewDecoder(zr).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if r := findParam(got.Parameter, "result"); r == nil || len(r.Part) != 1 || *r.Part[0].ValueString != "Alice" {
+		t.Errorf("unexpected result %+v", got)
+	}
+
+	resp, b = post(body, "", "gzip;q=0.2, deflate")
+	if resp.Header.Get("Content-Encoding") != "deflate" || !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("expected a deflate response, got %v", resp.Header)
+	}
+	zlr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("zlib: %v", err)
+	}
+	if plain, _ := io.ReadAll(zlr); !strings.Contains(string(plain), "Alice") {
+		t.Errorf("unexpected deflate body %q", plain)
+	}
+
+	// Small responses are not worth compressing
+	small, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("1")},
+		{Name: "resource", Resource: map[string]any{"resourceType": "Basic"}},
+	}})
+	if resp, b := post(small, "", "gzip"); resp.Header.Get("Content-Encoding") != "" || !strings.Contains(string(b), "Parameters") {
+		t.Errorf("expected an uncompressed response, got %v %q", resp.Header, b)
+	}
+
+	if resp, _ := post(body, "br", "gzip"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for an unsupported Content-Encoding, got %d", resp.StatusCode)
+	}
+
+	// The size limit applies to the decompressed body
+	large := bytes.Replace(body, []byte("Smith"), []byte(strings.Repeat("Smith", 10)), -1)
+	if resp, _ := post(gzipped(large), "gzip", ""); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a large decompressed body, got %d", resp.StatusCode)
+	}
+}
+
+func TestEchoResource(t *testing.T) {
+	patient := map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}
+	request := func(echo *param) parameters {
+		ps := []param{
+			{Name: "expression", ValueString: ptr.To("name.given")},
+			{Name: "resource", Resource: patient},
+		}
+		if echo != nil {
+			ps = append(ps, *echo)
+		}
+		return parameters{ResourceType: "Parameters", Parameter: ps}
+	}
+	echoed := func(got parameters) *param {
+		t.Helper()
+		if r := findParam(got.Parameter, "result"); r == nil || len(r.Part) != 1 {
+			t.Fatalf("expected the result, got %+v", got)
+		}
+		return findParam(findParam(got.Parameter, "parameters").Part, "resource")
+	}
+	resourceHash := func(p *param) string {
+		for _, ext := range p.Extension {
+			if ext.Url == resourceHashExtensionURL && ext.ValueString != nil {
+				return *ext.ValueString
+			}
+		}
+		return ""
+	}
+
+	ts := httptest.NewServer(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}}))
+	defer ts.Close()
+
+	if p := echoed(postJSON(t, ts, "/$fhirpath", request(nil))); p == nil || !strings.Contains(jsonValue(*p), "Alice") {
+		t.Errorf("expected the resource echoed by default, got %+v", p)
+	}
+	if p := echoed(postJSON(t, ts, "/$fhirpath", request(&param{Name: "echoResource", ValueBoolean: ptr.To(false)}))); p != nil {
+		t.Errorf("expected echoResource=false to omit the resource, got %+v", p)
+	}
+	hashed := echoed(postJSON(t, ts, "/$fhirpath-r5", request(&param{Name: "echoResource", ValueString: ptr.To("hash")})))
+	if hashed == nil || jsonValue(*hashed) != "" || !strings.HasPrefix(resourceHash(hashed), "sha256:") || len(resourceHash(hashed)) != len("sha256:")+64 {
+		t.Errorf("expected only the resource hash, got %+v", hashed)
+	}
+
+	body, _ := json.Marshal(request(&param{Name: "echoResource", ValueString: ptr.To("sometimes")}))
+	resp, err := http.Post(ts.URL+"/$fhirpath", "application/fhir+json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("expected an invalid echoResource to be rejected")
+	}
+
+	// The server default applies unless requested otherwise
+	omitting := httptest.NewServer(&rest.Server[model.R4]{Backend: &Backend{BaseURL: "", EchoResource: EchoResourceOmit}})
+	defer omitting.Close()
+	if p := echoed(postJSON(t, omitting, "/$fhirpath", request(nil))); p != nil {
+		t.Errorf("expected the server default to omit the resource, got %+v", p)
+	}
+	if p := echoed(postJSON(t, omitting, "/$fhirpath", request(&param{Name: "echoResource", ValueBoolean: ptr.To(true)}))); p == nil || jsonValue(*p) == "" {
+		t.Errorf("expected echoResource=true to echo the resource, got %+v", p)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exported := make(chan *coltracepb.ExportTraceServiceRequest, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer collector" {
+			t.Errorf("expected the configured headers, got %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		exported <- req
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	traced := func(traceparent string) []*tracepb.Span {
+		t.Helper()
+		tracer, err := NewTracer(TracingConfig{
+			Endpoint:       collector.URL + "/v1/traces",
+			Headers:        map[string]Secret{"Authorization": "Bearer collector"},
+			ServiceName:    "test",
+			SampleRatio:    1,
+			ExportInterval: Duration(time.Hour),
+		}, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatalf("tracer: %v", err)
+		}
+		ts := httptest.NewServer(tracer.Trace(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})))
+		defer ts.Close()
+
+		post := func(path, expression string) {
+			body, _ := json.Marshal(parameters{ResourceType: "Parameters", Parameter: []param{
+				{Name: "expression", ValueString: ptr.To(expression)},
+				{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice", "Bob"}}}}},
+			}})
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/fhir+json")
+			req.Header.Set("traceparent", traceparent)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("post: %v", err)
+			}
+			resp.Body.Close()
+		}
+		post("/$fhirpath-r5", "name.given")
+		post("/$fhirpath-r4", "name.given.where(")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracer.Shutdown(ctx); err != nil {
+			t.Fatalf("shutdown: %v", err)
+		}
+		if err := tracer.Shutdown(ctx); err != nil {
+			t.Fatalf("second shutdown: %v", err)
+		}
+		var spans []*tracepb.Span
+		for {
+			select {
+			case req := <-exported:
+				for _, rs := range req.ResourceSpans {
+					for _, ss := range rs.ScopeSpans {
+						spans = append(spans, ss.Spans...)
+					}
+				}
+			default:
+				return spans
+			}
+		}
+	}
+	attr := func(s *tracepb.Span, key string) string {
+		for _, a := range s.Attributes {
+			if a.Key == key {
+				switch v := a.Value.Value.(type) {
+				case *commonpb.AnyValue_StringValue:
+					return v.StringValue
+				case *commonpb.AnyValue_IntValue:
+					return strconv.FormatInt(v.IntValue, 10)
+				}
+			}
+		}
+		return ""
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spans := traced("00-" + traceID + "-00f067aa0ba902b7-01")
+	byName := map[string]*tracepb.Span{}
+	for _, s := range spans {
+		if hex.EncodeToString(s.TraceId) != traceID {
+			t.Errorf("expected span %q in the propagated trace, got %x", s.Name, s.TraceId)
+		}
+		if _, ok := byName[s.Name]; ok && attr(s, "fhirpath.release") != "R5" {
+			// Keep the spans of the successful R5 request
+			continue
+		}
+		byName[s.Name] = s
+	}
+	for _, name := range []string{"POST fhirpath-r5", "InvokeFHIRPathR5", "parseParameters", "evalFHIRPath", "buildR5Parameters", "InvokeFHIRPathR4"} {
+		if _, ok := byName[name]; !ok {
+			t.Fatalf("expected a %q span, got %+v", name, spans)
+		}
+	}
+	if server := byName["POST fhirpath-r5"]; hex.EncodeToString(server.ParentSpanId) != "00f067aa0ba902b7" || attr(server, "http.response.status_code") != "200" {
+		t.Errorf("expected the server span to continue the traceparent, got %+v", server)
+	}
+	eval := byName["evalFHIRPath"]
+	if attr(eval, "fhirpath.expression.length") != strconv.Itoa(len("name.given")) || attr(eval, "fhirpath.result.count") != "2" {
+		t.Errorf("expected the expression length and result count, got %+v", eval.Attributes)
+	}
+	if failed := byName["InvokeFHIRPathR4"]; failed.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || failed.Status.GetMessage() == "" {
+		t.Errorf("expected the failed operation span to carry the error, got %+v", failed.Status)
+	}
+
+	if spans := traced("00-" + traceID + "-00f067aa0ba902b7-00"); len(spans) != 0 {
+		t.Errorf("expected no spans for an unsampled trace, got %+v", spans)
+	}
+
+	// Without an endpoint nothing is recorded
+	tracer, err := NewTracer(TracingConfig{}, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("no-op tracer: %v", err)
+	}
+	tracer.Trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, span := startSpan(r.Context(), "evalFHIRPath"); span.IsRecording() {
+			t.Errorf("expected a non-recording span")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metadata", nil))
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Errorf("no-op shutdown: %v", err)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	patient := `{"resourceType":"Patient","name":[{"given":["Alice"]},{"given":["Bob"]}]}`
+	request := func(timing *param) parameters {
+		ps := []param{
+			{Name: "expression", ValueString: ptr.To("given")},
+			{Name: "context", ValueString: ptr.To("name")},
+			{Name: "resource", Extension: []struct {
+				Url         string  `json:"url"`
+				ValueString *string `json:"valueString,omitempty"`
+			}{{Url: "http://fhir.forms-lab.com/StructureDefinition/json-value", ValueString: ptr.To(patient)}}},
+		}
+		if timing != nil {
+			ps = append(ps, *timing)
+		}
+		return parameters{ResourceType: "Parameters", Parameter: ps}
+	}
+
+	cache, err := NewResponseCache(ResponseCacheConfig{Size: 10, TTL: Duration(time.Minute)})
+	if err != nil {
+		t.Fatalf("response cache: %v", err)
+	}
+	ts := httptest.NewServer(cache.Cache(ReleaseParameters(&rest.Server[model.R4]{Backend: &Backend{BaseURL: ""}})))
+	defer ts.Close()
+
+	for _, path := range []string{"/$fhirpath", "/$fhirpath-r4b", "/$fhirpath-r5"} {
+		got := postJSON(t, ts, path, request(&param{Name: "timing", ValueBoolean: ptr.To(true)}))
+		timing := findParam(findParam(got.Parameter, "parameters").Part, "timing")
+		if timing == nil {
+			t.Fatalf("%s: expected a timing part, got %+v", path, got)
+		}
+		var names []string
+		for _, p := range timing.Part {
+			names = append(names, p.Name)
+			if us, err := p.ValueDecimal.Float64(); err != nil || us < 0 {
+				t.Errorf("%s: expected microseconds for %s, got %q", path, p.Name, p.ValueDecimal)
+			}
+		}
+		want := "decodeResource parseExpression parseContext evaluateContext evaluate evaluate serialize"
+		if strings.Join(names, " ") != want {
+			t.Errorf("%s: expected the phases %s, got %v", path, want, names)
+		}
+		if us, _ := findParam(timing.Part, "decodeResource").ValueDecimal.Float64(); us <= 0 {
+			t.Errorf("%s: expected the json-value decoding timed, got %v", path, us)
+		}
+	}
+
+	if got := postJSON(t, ts, "/$fhirpath", request(nil)); findParam(findParam(got.Parameter, "parameters").Part, "timing") != nil {
+		t.Errorf("expected no timing unless requested")
+	}
+
+	// Embedded resources are decoded with the request, by ReleaseParameters or the server
+	embedded := parameters{ResourceType: "Parameters", Parameter: []param{
+		{Name: "expression", ValueString: ptr.To("name.given")},
+		{Name: "resource", Resource: map[string]any{"resourceType": "Patient", "name": []any{map[string]any{"given": []string{"Alice"}}}}},
+		{Name: "timing", ValueBoolean: ptr.To(true)},
+	}}
+	for _, path := range []string{"/$fhirpath", "/$fhirpath-r5", "/$fhirpath-auto"} {
+		timing := findParam(findParam(postJSON(t, ts, path, embedded).Parameter, "parameters").Part, "timing")
+		if us, _ := findParam(timing.Part, "decodeResource").ValueDecimal.Float64(); us <= 0 {
+			t.Errorf("%s: expected the request decoding timed, got %v", path, us)
+		}
+	}
+
+	// Timings are measured for every request, never served from the cache
+	body, _ := json.Marshal(request(&param{Name: "timing", ValueBoolean: ptr.To(true)}))
+	for range 2 {
+		resp, err := http.Post(ts.URL+"/$fhirpath", "application/fhir+json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("X-Cache") != "" {
+			t.Errorf("expected timing requests to bypass the response cache, got X-Cache %q", resp.Header.Get("X-Cache"))
+		}
+	}
+
+	body, _ = json.Marshal(request(&param{Name: "timing", ValueString: ptr.To("yes")}))
+	resp, err := http.Post(ts.URL+"/$fhirpath", "application/fhir+json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("expected an invalid timing parameter to be rejected")
+	}
+}
+
+func TestEncodePrimitiveExtensions(t *testing.T) {
+	ext := []r4.Extension{{Url: "http://hl7.org/fhir/StructureDefinition/data-absent-reason", Value: r4.Code{Value: ptr.To("masked")}}}
+	for _, tc := range []struct {
+		value any
+		want  string
+	}{
+		{r4.String{Value: ptr.To("Alice")}, `"Alice"`},
+		{r4.String{Id: ptr.To("g1"), Value: ptr.To("Alice")}, `{"value":"Alice","_value":{"id":"g1"}}`},
+		{r4.Date{Extension: ext}, `{"_value":{"extension":[{"url":"http://hl7.org/fhir/StructureDefinition/data-absent-reason","valueCode":"masked"}]}}`},
+		{r5.Integer64{Id: ptr.To("n"), Value: ptr.To(int64(1) << 40)}, `{"value":"1099511627776","_value":{"id":"n"}}`},
+	} {
+		got, err := encodeFHIRJSON(tc.value)
+		if err != nil || got != tc.want {
+			t.Errorf("encode %T: got %s (%v), want %s", tc.value, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// audience is the aud claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// jwt is a decoded, not yet verified, compact JWS.
+type jwt struct {
+	header    jwtHeader
+	claims    jwtClaims
+	signed    []byte
+	signature []byte
+}
+
+// looksLikeJWT tells JWTs apart from opaque API keys.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var t jwt
+	if err := decodeJWTPart(parts[0], &t.header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if err := decodeJWTPart(parts[1], &t.claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	t.signed = []byte(parts[0] + "." + parts[1])
+	t.signature = signature
+	return &t, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwtHashes maps the algorithm suffix to its hash function.
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+func (t *jwt) hash() (crypto.Hash, []byte, error) {
+	alg := t.header.Alg
+	h, ok := jwtHashes[alg[min(2, len(alg)):]]
+	if !ok {
+		return 0, nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write(t.signed)
+	return h, hasher.Sum(nil), nil
+}
+
+// verifyHMAC checks an HS256/HS384/HS512 signature.
+func (t *jwt) verifyHMAC(secret []byte) error {
+	if !strings.HasPrefix(t.header.Alg, "HS") {
+		return fmt.Errorf("unsupported algorithm %q", t.header.Alg)
+	}
+	h, _, err := t.hash()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(h.New, secret)
+	mac.Write(t.signed)
+	if !hmac.Equal(mac.Sum(nil), t.signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// ecdsaAlgorithms maps curves to the only algorithm using them.
+var ecdsaAlgorithms = map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}
+
+// verifyKey checks an RS*, PS* or ES* signature.
+func (t *jwt) verifyKey(key crypto.PublicKey) error {
+	h, digest, err := t.hash()
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch t.header.Alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(key, h, digest, t.signature)
+		case "PS":
+			err = rsa.VerifyPSS(key, h, digest, t.signature, nil)
+		default:
+			return fmt.Errorf("algorithm %q does not match an RSA key", t.header.Alg)
+		}
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if t.header.Alg != ecdsaAlgorithms[key.Curve.Params().Name] {
+			return fmt.Errorf("algorithm %q does not match the %s key", t.header.Alg, key.Curve.Params().Name)
+		}
+		if len(t.signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// validate checks the time and, if required, issuer and audience claims. Tokens must expire.
+func (t *jwt) validate(now time.Time, issuer, aud string) error {
+	c := t.claims
+	if c.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(*c.ExpiresAt), 0)) {
+		return errors.New("token expired")
+	}
+	if c.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*c.NotBefore), 0)) {
+		return errors.New("token not yet valid")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if aud != "" {
+		found := false
+		for _, a := range c.Audience {
+			found = found || a == aud
+		}
+		if !found {
+			return errors.New("token not issued for this audience")
+		}
+	}
+	if c.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	return nil
+}
+
+// jwk is a JSON Web Key, RSA or EC public keys only.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// loadJWKS reads the signature verification keys of a JSON Web Key Set file.
+func loadJWKS(file string) ([]jwksKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	var keys []jwksKey
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d: %w", file, i, err)
+		}
+		keys = append(keys, jwksKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no signature keys", file)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) { return base64.RawURLEncoding.DecodeString(s) }
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		curves := map[string]struct {
+			curve elliptic.Curve
+			ecdh  ecdh.Curve
+		}{
+			"P-256": {elliptic.P256(), ecdh.P256()},
+			"P-384": {elliptic.P384(), ecdh.P384()},
+			"P-521": {elliptic.P521(), ecdh.P521()},
+		}
+		c, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (c.curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		// ecdh validates the point is on the curve
+		if _, err := c.ecdh.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
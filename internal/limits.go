@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// MaxBodySize rejects request bodies larger than limit bytes with 413 Payload Too Large.
+// Bodies without a declared length are cut off at the limit while being read.
+func MaxBodySize(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > limit {
+				writeOperationOutcome(w, http.StatusRequestEntityTooLarge, "too-costly",
+					fmt.Sprintf("request body exceeds %d bytes", limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyTooLarge reports whether a body read failed because of MaxBodySize.
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// writeOperationOutcome writes an error OperationOutcome for failures outside the operations,
+// which the FHIR server reports the same way.
+func writeOperationOutcome(w http.ResponseWriter, status int, code, diagnostics string) {
+	body, err := json.Marshal(opErrR4("error", code, diagnostics))
+	if err != nil {
+		http.Error(w, diagnostics, status)
+		return
+	}
+	w.Header().Set("Content-Type", mimeFHIRJSON)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"reflect"
+)
+
+// resourceScope is the pair of resources bound to %resource and %rootResource for a focus element,
+// and the fullUrl of the Bundle entry holding rootResource, if any.
+type resourceScope struct {
+	resource     model.Resource
+	rootResource model.Resource
+	fullURL      string
+}
+
+// resourceLocator finds the enclosing resources of elements within an input resource.
+//
+// Elements don't know their parent, so the input tree is walked once, recording the scope of
+// every node. Nodes are indexed by the identity of the memory they share with the model (see
+// identityKey): context items returned by the engine are usually copies of these nodes and
+// therefore share the same pointers. Items without such pointers, e.g. element ids and extension
+// urls the model returns as System strings, are matched by value against the nodes of their type.
+type resourceLocator struct {
+	root   model.Resource
+	nodes  map[nodeKey][]locatedNode
+	byType map[reflect.Type][]locatedNode
+}
+
+type nodeKey struct {
+	typ reflect.Type
+	ptr uintptr
+}
+
+type locatedNode struct {
+	elem  fhirpath.Element
+	scope resourceScope
+}
+
+func newResourceLocator(root model.Resource) *resourceLocator {
+	l := &resourceLocator{root: root, nodes: make(map[nodeKey][]locatedNode), byType: make(map[reflect.Type][]locatedNode)}
+	l.walk(root, resourceScope{resource: root, rootResource: root})
+	return l
+}
+
+// walk indexes elem and its descendants. Resources nested directly in a resource are contained
+// resources and keep the container as %rootResource; resources nested in backbone elements
+// (Bundle entries, Parameters) start a new root.
+func (l *resourceLocator) walk(elem fhirpath.Element, scope resourceScope) {
+	node := locatedNode{elem: elem, scope: scope}
+	if key, ok := identityKey(elem); ok {
+		l.nodes[key] = append(l.nodes[key], node)
+	}
+	typ := reflect.TypeOf(elem)
+	l.byType[typ] = append(l.byType[typ], node)
+	_, parentIsResource := elem.(model.Resource)
+	for _, child := range elem.Children() {
+		childScope := scope
+		if res, ok := child.(model.Resource); ok {
+			childScope.resource = res
+			if !parentIsResource {
+				childScope.rootResource = res
+				childScope.fullURL = fullURLOf(elem)
+			}
+		}
+		l.walk(child, childScope)
+	}
+}
+
+// locate returns the scope of elem, false if it is not part of the input resource (e.g. computed
+// values). An element equal to nodes in different scopes can't be located and is reported in the error.
+func (l *resourceLocator) locate(elem fhirpath.Element) (resourceScope, bool, error) {
+	if key, ok := identityKey(elem); ok {
+		for _, n := range l.nodes[key] {
+			if sameElement(n.elem, elem) {
+				return n.scope, true, nil
+			}
+		}
+	}
+
+	var scope resourceScope
+	found := false
+	for _, n := range l.byType[reflect.TypeOf(elem)] {
+		if !reflect.DeepEqual(n.elem, elem) {
+			continue
+		}
+		if found && !sameScope(n.scope, scope) {
+			return resourceScope{}, false, fmt.Errorf("%s element %s occurs in several resources of the input, its enclosing resource is unknown", typeNameOf(elem), valueJSON(elem))
+		}
+		scope, found = n.scope, true
+	}
+	return scope, found, nil
+}
+
+// sameScope reports whether two scopes refer to the same resources of the input.
+func sameScope(a, b resourceScope) bool {
+	return a.fullURL == b.fullURL &&
+		sameElement(a.resource.(fhirpath.Element), b.resource.(fhirpath.Element)) &&
+		sameElement(a.rootResource.(fhirpath.Element), b.rootResource.(fhirpath.Element))
+}
+
+// fullURLOf returns the fullUrl of a Bundle entry, empty for other elements.
+func fullURLOf(entry fhirpath.Element) string {
+	if fu := entry.Children("fullUrl"); len(fu) > 0 {
+		if s, ok, _ := fu[0].ToString(false); ok {
+			return string(s)
+		}
+	}
+	return ""
+}
+
+// identityKey derives a key from the first non-nil pointer found in the element value.
+// Elements without any pointers carry no identity and are not indexed.
+func identityKey(elem fhirpath.Element) (nodeKey, bool) {
+	v := reflect.ValueOf(elem)
+	if p, ok := firstPointer(v); ok {
+		return nodeKey{typ: v.Type(), ptr: p}, true
+	}
+	return nodeKey{}, false
+}
+
+func firstPointer(v reflect.Value) (uintptr, bool) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Map:
+		if !v.IsNil() {
+			return v.Pointer(), true
+		}
+	case reflect.Slice:
+		if v.Len() > 0 {
+			return v.Pointer(), true
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			return firstPointer(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if p, ok := firstPointer(v.Field(i)); ok {
+				return p, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// sameElement reports whether a and b are copies of the same model node, i.e. all their
+// pointers and slices refer to the same memory.
+func sameElement(a, b fhirpath.Element) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	return va.Type() == vb.Type() && sameValue(va, vb)
+}
+
+func sameValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Pointer, reflect.Map:
+		return a.Pointer() == b.Pointer()
+	case reflect.Slice:
+		return a.Len() == b.Len() && (a.Len() == 0 || a.Pointer() == b.Pointer())
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && sameValue(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !sameValue(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.Equal(b)
+	}
+}
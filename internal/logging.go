@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// LogConfig controls which request content is logged. Users sometimes paste real patient data,
+// so resources are redacted unless enabled explicitly.
+type LogConfig struct {
+	// Expressions logs the expression text in addition to its hash.
+	Expressions bool `json:"expressions"`
+	// Resources logs the submitted resource.
+	Resources bool `json:"resources"`
+}
+
+// maxRequestIDLength bounds client-supplied X-Request-ID values.
+const maxRequestIDLength = 128
+
+// RequestLogger logs one structured record per request: request ID (X-Request-ID, generated if
+// absent or invalid, and echoed in the response), authenticated principal, operation, release,
+// expression hash, duration, outcome and error class, plus the trace ID when served behind Tracer.Trace.
+func RequestLogger(logger *slog.Logger, config LogConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-ID")
+			if !validRequestID(requestID) {
+				requestID = newRequestID()
+			}
+			w.Header().Set("X-Request-ID", requestID)
+
+			ctx, info := withRequestInfo(r.Context())
+			info.requestID = requestID
+			rec := &statusRecorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(rec, r.WithContext(ctx))
+			elapsed := time.Since(start)
+
+			operation := operationName(r)
+			release := info.release
+			if release == "" {
+				release = operationRelease(operation)
+			}
+			status := rec.statusCode()
+			attrs := []slog.Attr{
+				slog.String("request_id", requestID),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("operation", operation),
+				slog.Int("status", status),
+				slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+				slog.Int("bytes", rec.bytes),
+			}
+			if span := trace.SpanFromContext(r.Context()); span.IsRecording() {
+				attrs = append(attrs, slog.String("trace_id", span.SpanContext().TraceID().String()))
+			}
+			if info.principal != "" {
+				attrs = append(attrs, slog.String("principal", info.principal))
+			}
+			if release != "" {
+				attrs = append(attrs, slog.String("release", release))
+			}
+			if info.cached {
+				attrs = append(attrs, slog.Bool("cached", true))
+			}
+			if info.expression != "" {
+				attrs = append(attrs, slog.String("expression_hash", expressionHash(info.expression)))
+				if config.Expressions {
+					attrs = append(attrs, slog.String("expression", info.expression))
+				}
+			}
+			if config.Resources && info.resource != nil {
+				if s, err := encodeFHIRJSON(info.resource); err == nil {
+					attrs = append(attrs, slog.String("resource", s))
+				}
+			}
+
+			level, outcome := slog.LevelInfo, "success"
+			if class := errorClass(info, status); class != "" {
+				outcome = "error"
+				attrs = append(attrs, slog.String("error_class", class))
+				level = slog.LevelWarn
+				if status >= 500 {
+					level = slog.LevelError
+				}
+			}
+			attrs = append(attrs, slog.String("outcome", outcome))
+			logger.LogAttrs(r.Context(), level, "request", attrs...)
+		})
+	}
+}
+
+// expressionHash identifies an expression in logs without revealing it.
+func expressionHash(expression string) string {
+	sum := sha256.Sum256([]byte(expression))
+	return hex.EncodeToString(sum[:8])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
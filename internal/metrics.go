@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics collects request and evaluation metrics and exposes them in the Prometheus text format.
+//
+// Instrument records every request passing through it; evaluation details (release, parse and
+// evaluation time, result size, error class) are reported by the backend via requestInfo.
+// CountInFlight counts the evaluations in progress, it belongs behind Authenticate and Throttle.
+type Metrics struct {
+	// ParseCache optionally adds the hit/miss counters of the expression cache.
+	ParseCache *ParseCache
+	// ResponseCache optionally adds the hit/miss counters of the response cache.
+	ResponseCache *ResponseCache
+
+	requests   *counterVec
+	duration   *histogramVec
+	parse      *histogramVec
+	evaluation *histogramVec
+	errors     *counterVec
+	resultSize *histogramVec
+	inFlight   atomic.Int64
+}
+
+var (
+	durationBuckets   = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	resultSizeBuckets = []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+)
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newCounterVec("fhirpath_lab_requests_total",
+			"Requests by operation, release and HTTP status code.", "operation", "release", "code"),
+		duration: newHistogramVec("fhirpath_lab_request_duration_seconds",
+			"Request latency by operation and release.", durationBuckets, "operation", "release"),
+		parse: newHistogramVec("fhirpath_lab_parse_duration_seconds",
+			"Time spent parsing the expression and context of a request.", durationBuckets, "release"),
+		evaluation: newHistogramVec("fhirpath_lab_evaluation_duration_seconds",
+			"Time spent evaluating the expression and context of a request.", durationBuckets, "release"),
+		errors: newCounterVec("fhirpath_lab_errors_total",
+			"Failed requests by operation and error class (parse, evaluation, request, internal).", "operation", "class"),
+		resultSize: newHistogramVec("fhirpath_lab_result_size",
+			"Number of result values per evaluated request.", resultSizeBuckets, "operation"),
+	}
+}
+
+// Instrument records the metrics of requests handled by next.
+func (m *Metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := operationName(r)
+		evaluates := isEvaluation(r)
+
+		ctx, info := withRequestInfo(r.Context())
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		elapsed := time.Since(start)
+
+		release := info.release
+		if release == "" {
+			release = operationRelease(operation)
+		}
+		status := rec.statusCode()
+		m.requests.add(1, operation, release, strconv.Itoa(status))
+		m.duration.observe(elapsed.Seconds(), operation, release)
+
+		if info.release != "" && !info.cached {
+			m.parse.observe(info.parse.Seconds(), info.release)
+			m.evaluation.observe(info.evaluation.Seconds(), info.release)
+		}
+		if class := errorClass(info, status); class != "" {
+			m.errors.add(1, operation, class)
+		} else if evaluates {
+			m.resultSize.observe(float64(info.results), operation)
+		}
+	})
+}
+
+// CountInFlight counts the evaluations handled by next while they are in progress.
+func (m *Metrics) CountInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isEvaluation(r) {
+			m.inFlight.Add(1)
+			defer m.inFlight.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorClass classifies a failed request: evaluation failures as reported by the backend,
+// otherwise "request" for client and "internal" for server errors. Requests that succeeded
+// have no class, even if an evaluation failed along the way (e.g. in one release of
+// $fhirpath-compare).
+func errorClass(info *requestInfo, status int) string {
+	switch {
+	case status < 400:
+		return ""
+	case info.errorClass != "":
+		return info.errorClass
+	case status >= 500:
+		return "internal"
+	}
+	return "request"
+}
+
+// Handler serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		m.requests.write(bw)
+		m.duration.write(bw)
+		m.parse.write(bw)
+		m.evaluation.write(bw)
+		m.errors.write(bw)
+		m.resultSize.write(bw)
+		writeSample(bw, "fhirpath_lab_evaluations_in_flight", "Operation requests currently being evaluated.", "gauge", float64(m.inFlight.Load()))
+		if m.ParseCache != nil {
+			s := m.ParseCache.Stats()
+			writeSample(bw, "fhirpath_lab_parse_cache_hits_total", "Expression parse cache hits.", "counter", float64(s.Hits))
+			writeSample(bw, "fhirpath_lab_parse_cache_misses_total", "Expression parse cache misses.", "counter", float64(s.Misses))
+			writeSample(bw, "fhirpath_lab_parse_cache_evictions_total", "Expressions evicted from the parse cache.", "counter", float64(s.Evictions))
+			writeSample(bw, "fhirpath_lab_parse_cache_entries", "Expressions currently in the parse cache.", "gauge", float64(s.Len))
+			writeSample(bw, "fhirpath_lab_parse_cache_bytes", "Length of the expressions currently in the parse cache.", "gauge", float64(s.Bytes))
+		}
+		if m.ResponseCache != nil {
+			s := m.ResponseCache.Stats()
+			writeSample(bw, "fhirpath_lab_response_cache_hits_total", "Responses served from the response cache.", "counter", float64(s.Hits))
+			writeSample(bw, "fhirpath_lab_response_cache_misses_total", "Response cache misses.", "counter", float64(s.Misses))
+			writeSample(bw, "fhirpath_lab_response_cache_evictions_total", "Responses evicted from the in-memory response cache.", "counter", float64(s.Evictions))
+			writeSample(bw, "fhirpath_lab_response_cache_entries", "Responses currently cached in memory.", "gauge", float64(s.Len))
+			writeSample(bw, "fhirpath_lab_response_cache_bytes", "Size of the responses currently cached in memory.", "gauge", float64(s.Bytes))
+		}
+		bw.Flush()
+	})
+}
+
+func writeSample(w *bufio.Writer, name, help, typ string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(value))
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labelValues), formatFloat(s.value))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// counts holds the non-cumulative count per bucket, the last one being +Inf.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, v)]++
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		labels := append([]string{}, h.labels...)
+		var cumulative uint64
+		for i, n := range s.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(append(labels, "le"), append(append([]string{}, s.labelValues...), le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labelValues), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
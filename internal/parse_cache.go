@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"container/list"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"sync"
+)
+
+// ParseCache is a concurrency-safe, size-bounded LRU cache of parsed FHIRPath expressions,
+// keyed by expression text and release.
+//
+// The lab re-posts the same expression with every edit of the resource, so parsing is skipped for
+// all but the first request. Parse errors are cached as well, as incomplete expressions are
+// re-posted just the same while typing. Besides the number of expressions the cache bounds their
+// total length, as parsed expressions grow with their text and request bodies can be large.
+type ParseCache struct {
+	size     int
+	maxBytes int64
+
+	mu        sync.Mutex
+	entries   *list.List
+	items     map[parseKey]*list.Element
+	bytes     int64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type parseKey struct {
+	release    string
+	expression string
+}
+
+type parseEntry struct {
+	key  parseKey
+	expr fhirpath.Expression
+	err  error
+}
+
+// ParseCacheStats is a snapshot of the cache counters.
+type ParseCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Len       int
+	Size      int
+	Bytes     int64
+}
+
+// NewParseCache returns a cache holding up to size expressions of up to maxBytes in total, 0 for no
+// byte bound. A size of 0 or less disables caching.
+func NewParseCache(size int, maxBytes int64) *ParseCache {
+	return &ParseCache{size: size, maxBytes: maxBytes, entries: list.New(), items: make(map[parseKey]*list.Element)}
+}
+
+// Parse returns the parsed expression for the release, parsing it on a cache miss.
+// A nil cache parses every time.
+func (c *ParseCache) Parse(release, expression string) (fhirpath.Expression, error) {
+	if c == nil || c.size <= 0 {
+		return fhirpath.Parse(expression)
+	}
+
+	key := parseKey{release: release, expression: expression}
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		c.entries.MoveToFront(e)
+		c.hits++
+		entry := e.Value.(*parseEntry)
+		c.mu.Unlock()
+		return entry.expr, entry.err
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// Parse outside the lock, concurrent misses for the same key parse twice and keep one result
+	expr, err := fhirpath.Parse(expression)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; !ok && (c.maxBytes <= 0 || int64(len(expression)) <= c.maxBytes) {
+		c.items[key] = c.entries.PushFront(&parseEntry{key: key, expr: expr, err: err})
+		c.bytes += int64(len(expression))
+		for c.entries.Len() > c.size || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+			oldest := c.entries.Remove(c.entries.Back()).(*parseEntry)
+			delete(c.items, oldest.key)
+			c.bytes -= int64(len(oldest.key.expression))
+			c.evictions++
+		}
+	}
+	return expr, err
+}
+
+// Stats returns the current hit, miss and eviction counts and the number and length of cached expressions.
+func (c *ParseCache) Stats() ParseCacheStats {
+	if c == nil {
+		return ParseCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ParseCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       c.entries.Len(),
+		Size:      c.size,
+		Bytes:     c.bytes,
+	}
+}
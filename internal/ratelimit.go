@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit is a token bucket: Rate requests per second sustained, bursts of up to Burst requests.
+type RateLimit struct {
+	// Rate is in requests per second, 0 for no limit.
+	Rate float64 `json:"rate"`
+	// Burst is the bucket size, at least 1.
+	Burst int `json:"burst"`
+}
+
+// Enabled reports whether the limit restricts anything.
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0
+}
+
+func (l RateLimit) burst() float64 {
+	return math.Max(float64(l.Burst), 1)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// idle is when the bucket refilled completely, so it can be dropped
+	idle time.Time
+}
+
+// rateLimiter keeps a token bucket per key (API key, principal or client address).
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+// sweepInterval is how often buckets which refilled completely are dropped.
+const sweepInterval = time.Minute
+
+// allow takes a token from the bucket of key. If none is left, it returns how long until the
+// next token is available.
+func (l *rateLimiter) allow(key string, limit RateLimit) (bool, time.Duration) {
+	if !limit.Enabled() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.lastSweep = now
+		for k, b := range l.buckets {
+			if !now.Before(b.idle) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst(), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	b.idle = now.Add(time.Duration((limit.burst() - b.tokens) / limit.Rate * float64(time.Second)))
+	return true, 0
+}
+
+// refund returns the token taken from the bucket of key by allow.
+func (l *rateLimiter) refund(key string, limit RateLimit) {
+	if !limit.Enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(limit.burst(), b.tokens+1)
+	}
+}
+
+// writeTooManyRequests rejects a request with 429, telling the client when to retry.
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, diagnostics string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	writeOperationOutcome(w, http.StatusTooManyRequests, "throttled", diagnostics)
+}
+
+func (l RateLimit) validate(name string) []error {
+	var errs []error
+	if l.Rate < 0 {
+		errs = append(errs, fmt.Errorf("%s.rate must not be negative", name))
+	}
+	if l.Burst < 0 {
+		errs = append(errs, fmt.Errorf("%s.burst must not be negative", name))
+	}
+	return errs
+}
+
+// ThrottleConfig protects the evaluations from clients sending too many requests.
+type ThrottleConfig struct {
+	// PerClient limits the requests of each client: the authenticated principal if any (unless
+	// its API key has a limit of its own), the client address otherwise.
+	PerClient RateLimit `json:"perClient"`
+	// ClientIPHeader names a header carrying the client address set by a trusted proxy, e.g.
+	// Fly-Client-IP. For X-Forwarded-For the last address, added by the proxy, is used.
+	ClientIPHeader string `json:"clientIPHeader,omitempty"`
+	// MaxConcurrent caps concurrent evaluations, 0 for no cap.
+	MaxConcurrent int `json:"maxConcurrent"`
+	// MaxQueue is the number of evaluations waiting for a slot, further ones are rejected.
+	MaxQueue int `json:"maxQueue"`
+	// QueueTimeout bounds the wait for a slot.
+	QueueTimeout Duration `json:"queueTimeout"`
+}
+
+func (c ThrottleConfig) validate() []error {
+	errs := c.PerClient.validate("throttle.perClient")
+	if c.MaxConcurrent < 0 {
+		errs = append(errs, errors.New("throttle.maxConcurrent must not be negative"))
+	}
+	if c.MaxQueue < 0 {
+		errs = append(errs, errors.New("throttle.maxQueue must not be negative"))
+	}
+	if c.QueueTimeout < 0 {
+		errs = append(errs, errors.New("throttle.queueTimeout must not be negative"))
+	}
+	return errs
+}
+
+// queueRetryAfter is suggested to clients rejected because all evaluation slots are taken.
+const queueRetryAfter = time.Second
+
+// Throttler rejects requests over the per-client rate limits, and evaluations exceeding the
+// concurrency cap once the wait queue is full or the wait timed out, with 429 Too Many Requests.
+//
+// Clients are limited in two stages around Authenticate: Addresses limits each client address
+// before the credentials are checked, so failed authentication attempts are limited too, and
+// Principals limits each authenticated principal. Requests that authenticate are only charged to
+// their principal, so API keys with a limit of their own are not capped by their address.
+type Throttler struct {
+	config     ThrottleConfig
+	addresses  *rateLimiter
+	principals *rateLimiter
+	slots      chan struct{}
+	queued     atomic.Int64
+}
+
+// NewThrottler returns a Throttler sharing its buckets and evaluation slots between both stages.
+func NewThrottler(config ThrottleConfig) *Throttler {
+	t := &Throttler{config: config, addresses: newRateLimiter(), principals: newRateLimiter()}
+	if config.MaxConcurrent > 0 {
+		t.slots = make(chan struct{}, config.MaxConcurrent)
+	}
+	return t
+}
+
+// Throttle limits clients by address and caps concurrent evaluations, for servers without
+// authentication. With authentication use a Throttler's Addresses and Principals around Authenticate.
+func Throttle(config ThrottleConfig) func(http.Handler) http.Handler {
+	t := NewThrottler(config)
+	return func(next http.Handler) http.Handler {
+		return t.Addresses(t.Principals(next))
+	}
+}
+
+// Addresses rejects requests over the rate limit of their client address. The token is returned
+// once the request authenticated as a principal further down the chain.
+func (t *Throttler) Addresses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, info := withRequestInfo(r.Context())
+		address := clientIP(r, t.config.ClientIPHeader)
+		if ok, retryAfter := t.addresses.allow(address, t.config.PerClient); !ok {
+			writeTooManyRequests(w, retryAfter, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+		if info.principal != "" {
+			t.addresses.refund(address, t.config.PerClient)
+		}
+	})
+}
+
+// Principals rejects requests over the rate limit of their principal and caps concurrent
+// evaluations. It runs behind Authenticate, requests without a principal are limited by Addresses.
+func (t *Throttler) Principals(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r.Context())
+		if info.principal != "" {
+			limit := t.config.PerClient
+			if info.principalRateLimit != nil {
+				limit = *info.principalRateLimit
+			}
+			if ok, retryAfter := t.principals.allow(info.principal, limit); !ok {
+				writeTooManyRequests(w, retryAfter, "rate limit exceeded")
+				return
+			}
+		}
+
+		if t.slots == nil || !isEvaluation(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case t.slots <- struct{}{}:
+		default:
+			if t.queued.Add(1) > int64(t.config.MaxQueue) {
+				t.queued.Add(-1)
+				writeTooManyRequests(w, queueRetryAfter, "server busy, too many evaluations waiting")
+				return
+			}
+			acquired := waitForSlot(r.Context(), t.slots, time.Duration(t.config.QueueTimeout))
+			t.queued.Add(-1)
+			if !acquired {
+				writeTooManyRequests(w, queueRetryAfter, "server busy, timed out waiting for an evaluation slot")
+				return
+			}
+		}
+		defer func() { <-t.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func waitForSlot(ctx context.Context, slots chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// clientIP returns the client address of r, taken from header if set by a trusted proxy.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if v := r.Header.Values(header); len(v) > 0 {
+			// Proxies append to X-Forwarded-For, earlier entries may be forged by the client
+			addrs := strings.Split(v[len(v)-1], ",")
+			if ip := strings.TrimSpace(addrs[len(addrs)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type nativeParametersKey struct{}
+type releaseDetectionKey struct{}
+
+// releaseOperations maps release-specific operation codes to a decoder for their own release.
+var releaseOperations = map[string]func(data []byte, format string) (model.Resource, error){
+	"fhirpath-r4b": decodeResource[model.R4B],
+	"fhirpath-r5":  decodeResource[model.R5],
+}
+
+// releaseDecoders decodes a resource in the given format by release name.
+var releaseDecoders = map[string]func(data []byte, format string) (model.Resource, error){
+	"R4":  decodeResource[model.R4],
+	"R4B": decodeResource[model.R4B],
+	"R5":  decodeResource[model.R5],
+}
+
+// ReleaseParameters decodes the body of release-specific operations (e.g. $fhirpath-r5) as Parameters
+// of that release and passes them to the backend via the request context. For $fhirpath-auto the
+// release is detected from the submitted resource first, $fhirpath-compare gets the body decoded in
+// every release.
+//
+// rest.Server parses every body as R4, which would reject or degrade resources only defined in later
+// releases. The request body is therefore replaced by an empty one once the native decoding succeeded.
+// Bodies of the release-specific operations that don't decode in their release are rejected with an
+// OperationOutcome. For $fhirpath-auto and $fhirpath-compare the request is passed on unchanged
+// if no release decodes it, so the server reports the error as usual.
+//
+// The time spent decoding the body, here or by the server for the R4 operations, is passed on
+// for the timing output.
+func ReleaseParameters(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, isOperation := strings.CutPrefix(r.URL.Path, "/$")
+		if r.Method != http.MethodPost || !isOperation || !operations[code] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		decode, ok := releaseOperations[code]
+		if !ok && code != "fhirpath-auto" && code != "fhirpath-compare" {
+			next.ServeHTTP(w, r.WithContext(withFrameworkDecoding(r.Context())))
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			if bodyTooLarge(err) {
+				writeOperationOutcome(w, http.StatusRequestEntityTooLarge, "too-costly", err.Error())
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("_format")
+		if format == "" {
+			format = r.Header.Get("Content-Type")
+		}
+
+		// passOn leaves decoding to the server, e.g. to report the error
+		passOn := func() {
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			next.ServeHTTP(w, r.WithContext(withFrameworkDecoding(r.Context())))
+		}
+
+		ctx := r.Context()
+		start := time.Now()
+		switch code {
+		case "fhirpath-auto":
+			detection, err := detectParameters(data, format, requestFHIRVersion(ctx))
+			if err != nil {
+				r = r.WithContext(context.WithValue(ctx, releaseDetectionKey{}, releaseDetection{err: err}))
+				passOn()
+				return
+			}
+			ctx = context.WithValue(ctx, releaseDetectionKey{}, detection)
+		case "fhirpath-compare":
+			cp := compareParameters{params: map[string]fhirpath.Element{}, errs: map[string]error{}}
+			for _, release := range releaseOrder {
+				res, err := releaseDecoders[release](data, format)
+				switch {
+				case err != nil:
+					cp.errs[release] = err
+				case res.ResourceType() != "Parameters":
+					cp.errs[release] = fmt.Errorf("expected Parameters, got %s", res.ResourceType())
+				default:
+					cp.params[release] = res.(fhirpath.Element)
+				}
+			}
+			if len(cp.params) == 0 {
+				passOn()
+				return
+			}
+			ctx = context.WithValue(ctx, compareParametersKey{}, cp)
+		default:
+			// The server would decode the body as R4 and evaluate it in the requested release
+			// regardless, so failures are reported here
+			res, err := decode(data, format)
+			if err == nil && res.ResourceType() != "Parameters" {
+				err = fmt.Errorf("expected Parameters, got %s", res.ResourceType())
+			}
+			if err != nil {
+				writeOperationOutcome(w, http.StatusBadRequest, "invalid", err.Error())
+				return
+			}
+			ctx = context.WithValue(ctx, nativeParametersKey{}, res.(fhirpath.Element))
+		}
+
+		r = r.WithContext(withRequestDecoding(ctx, time.Since(start)))
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nativeParameters returns the Parameters decoded by ReleaseParameters, falling back to the
+// Parameters parsed by the framework.
+func nativeParameters(ctx context.Context, parsed fhirpath.Element) fhirpath.Element {
+	if p, ok := ctx.Value(nativeParametersKey{}).(fhirpath.Element); ok {
+		return p
+	}
+	return parsed
+}
+
+// decodeResource decodes a resource of release R in the given format (JSON unless XML is requested).
+func decodeResource[R model.Release](data []byte, format string) (model.Resource, error) {
+	if fhirFormat(format) == mimeFHIRXML {
+		return decodeResourceFromXML[R](string(data))
+	}
+	return decodeResourceFromJSON[R](string(data))
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo collects what the backend learns about an operation request while evaluating it,
+// for the middlewares reporting on the request once it completed.
+type requestInfo struct {
+	// requestID correlates the request across logs, set by RequestLogger.
+	requestID string
+	// principal is the authenticated caller ("method:name"), set by Authenticate.
+	principal string
+	// principalRateLimit is the rate limit of the principal's API key, if it has its own.
+	principalRateLimit *RateLimit
+	// release is the release evaluated in, "all" if several were ($fhirpath-compare).
+	release    string
+	expression string
+	resource   model.Resource
+	// errorClass classifies evaluation failures: "parse" or "evaluation". It only applies if the
+	// request failed, see errorClass.
+	errorClass string
+	results    int
+	// cached is set if the response was served from the response cache, without evaluating.
+	cached     bool
+	parse      time.Duration
+	evaluation time.Duration
+}
+
+// withRequestInfo returns a context carrying info, unless ctx already carries one.
+func withRequestInfo(ctx context.Context) (context.Context, *requestInfo) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return ctx, info
+	}
+	info := &requestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+// requestInfoFrom returns the requestInfo of ctx. Without one (e.g. not served behind the
+// middlewares) a throwaway value is returned, so callers don't need to check.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+func (info *requestInfo) setRelease(release string) {
+	if info.release != "" && info.release != release {
+		release = "all"
+	}
+	info.release = release
+}
+
+// operations are the codes of the operations served. Other codes are reported as "other", so
+// clients can't create metric series or span names at will.
+var operations = map[string]bool{
+	"fhirpath":         true,
+	"fhirpath-r4":      true,
+	"fhirpath-r4b":     true,
+	"fhirpath-r5":      true,
+	"fhirpath-auto":    true,
+	"fhirpath-compare": true,
+}
+
+// operationName returns the operation code of an operation request path (e.g. "fhirpath-r5"),
+// "metadata" for the capability statement and "other" for everything else.
+func operationName(r *http.Request) string {
+	if code, ok := strings.CutPrefix(r.URL.Path, "/$"); ok && operations[code] {
+		return code
+	}
+	if r.URL.Path == "/metadata" {
+		return "metadata"
+	}
+	return "other"
+}
+
+// isEvaluation reports whether r invokes an operation, evaluating expressions.
+func isEvaluation(r *http.Request) bool {
+	operation := operationName(r)
+	return r.Method == http.MethodPost && operation != "metadata" && operation != "other"
+}
+
+// operationRelease returns the release an operation evaluates in, if fixed by its code.
+func operationRelease(operation string) string {
+	switch operation {
+	case "fhirpath", "fhirpath-r4":
+		return "R4"
+	case "fhirpath-r4b":
+		return "R4B"
+	case "fhirpath-r5":
+		return "R5"
+	case "fhirpath-compare":
+		return "all"
+	}
+	return ""
+}
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"strings"
+)
+
+// errUnresolved reports a reference that points to no known resource.
+var errUnresolved = errors.New("unresolved reference")
+
+// referenceResolver resolves references against the resources submitted with a request:
+// the input resource itself, its contained resources and (for Bundles) the entries.
+//
+// References are resolved in the scope of the element holding them: local references ("#id")
+// against the contained resources of its %rootResource, relative references against the base
+// of its Bundle entry's fullUrl.
+type referenceResolver struct {
+	root model.Resource
+	// locator finds the scope of reference elements within the input.
+	// It walks the whole input and is therefore only built on first use, see resourceLocator.
+	locator *resourceLocator
+	// focus is the context item being evaluated, if any. References that are not part of the
+	// input, e.g. string literals, are resolved in its scope.
+	focus fhirpath.Element
+	// byURL indexes Bundle entries by their fullUrl.
+	byURL map[string]model.Resource
+	// byTypeID indexes all known resources by "type/id".
+	byTypeID map[string]model.Resource
+	// fallback is consulted for references not found in the input, e.g. the local resource store.
+	fallback func(ref string) (model.Resource, error)
+
+	warnings []string
+	warned   map[string]bool
+}
+
+func newReferenceResolver(root model.Resource) *referenceResolver {
+	r := &referenceResolver{
+		root:     root,
+		byURL:    make(map[string]model.Resource),
+		byTypeID: make(map[string]model.Resource),
+		warned:   make(map[string]bool),
+	}
+	r.index(root, "")
+	return r
+}
+
+// index registers a resource and, for Bundles, all entries recursively.
+func (r *referenceResolver) index(res model.Resource, fullURL string) {
+	if fullURL != "" {
+		r.byURL[fullURL] = res
+	}
+	if id, ok := res.ResourceId(); ok && id != "" {
+		key := res.ResourceType() + "/" + id
+		if _, exists := r.byTypeID[key]; !exists {
+			r.byTypeID[key] = res
+		}
+	}
+
+	if res.ResourceType() != "Bundle" {
+		return
+	}
+	for _, entry := range res.Children("entry") {
+		entryURL := fullURLOf(entry)
+		for _, e := range entry.Children("resource") {
+			if er, ok := e.(model.Resource); ok {
+				r.index(er, entryURL)
+			}
+		}
+	}
+}
+
+// resourceLocator returns the locator for the input, building it on first use.
+func (r *referenceResolver) resourceLocator() *resourceLocator {
+	if r.locator == nil {
+		r.locator = newResourceLocator(r.root)
+	}
+	return r.locator
+}
+
+// scopeOf returns %resource and %rootResource for the given focus element.
+// Elements that can't be located (e.g. computed values) fall back to the input resource.
+func (r *referenceResolver) scopeOf(elem fhirpath.Element) resourceScope {
+	scope, ok, err := r.resourceLocator().locate(elem)
+	if err != nil {
+		r.warn(err.Error())
+	}
+	if !ok {
+		return resourceScope{resource: r.root, rootResource: r.root}
+	}
+	return scope
+}
+
+// resolve implements the FHIR resolve() function for the evaluation context.
+// Items that can not be resolved are skipped and reported as warnings.
+func (r *referenceResolver) resolve(
+	ctx context.Context,
+	root fhirpath.Element, target fhirpath.Collection,
+	inputOrdered bool,
+	parameters []fhirpath.Expression,
+	evaluate fhirpath.EvaluateFunc,
+) (result fhirpath.Collection, resultOrdered bool, err error) {
+	if len(parameters) != 0 {
+		return nil, false, fmt.Errorf("expected no parameters")
+	}
+
+	for _, item := range target {
+		ref, ok := referenceString(item)
+		if !ok {
+			continue
+		}
+		scope, ok, err := r.resourceLocator().locate(item)
+		if err != nil {
+			r.warn(err.Error())
+		}
+		if !ok {
+			scope = resourceScope{resource: r.root, rootResource: r.root}
+			if r.focus != nil {
+				scope = r.scopeOf(r.focus)
+			}
+		}
+		res, err := r.lookup(ref, scope)
+		if errors.Is(err, errUnresolved) {
+			r.warn(fmt.Sprintf("unable to resolve reference '%s'", ref))
+			continue
+		}
+		if err != nil {
+			r.warn(fmt.Sprintf("unable to resolve reference '%s': %v", ref, err))
+			continue
+		}
+		result = append(result, res)
+	}
+	return result, inputOrdered, nil
+}
+
+// lookup finds the resource a reference in the given scope points to. Absolute references
+// match Bundle entries by fullUrl. Relative references are resolved against the base of the
+// entry's fullUrl if it is a RESTful URL and, failing that, matched by type and id.
+func (r *referenceResolver) lookup(ref string, scope resourceScope) (model.Resource, error) {
+	if ref == "#" {
+		return scope.rootResource, nil
+	}
+	if strings.HasPrefix(ref, "#") {
+		for _, c := range scope.rootResource.Children("contained") {
+			if cr, ok := c.(model.Resource); ok {
+				if id, ok := cr.ResourceId(); ok && "#"+id == ref {
+					return cr, nil
+				}
+			}
+		}
+		return nil, errUnresolved
+	}
+
+	ref = trimHistory(ref)
+	if absoluteReference(ref) {
+		if res, ok := r.byURL[ref]; ok {
+			return res, nil
+		}
+	} else {
+		if base, ok := restfulBase(scope.fullURL); ok {
+			if res, ok := r.byURL[base+ref]; ok {
+				return res, nil
+			}
+		}
+		if typeID, ok := referenceTypeID(ref); ok {
+			if res, ok := r.byTypeID[typeID]; ok {
+				return res, nil
+			}
+		}
+	}
+
+	if r.fallback != nil {
+		return r.fallback(ref)
+	}
+	return nil, errUnresolved
+}
+
+func (r *referenceResolver) warn(msg string) {
+	if r.warned[msg] {
+		return
+	}
+	r.warned[msg] = true
+	r.warnings = append(r.warnings, msg)
+}
+
+// referenceString extracts the reference from a Reference element or a uri/canonical/string primitive.
+func referenceString(e fhirpath.Element) (string, bool) {
+	if typeNameOf(e) == "Reference" {
+		refs := e.Children("reference")
+		if len(refs) == 0 {
+			return "", false
+		}
+		e = refs[0]
+	}
+	s, ok, err := e.ToString(false)
+	if err != nil || !ok || string(s) == "" {
+		return "", false
+	}
+	return string(s), true
+}
+
+// absoluteReference reports whether ref is an absolute URL or URN rather than a relative reference.
+func absoluteReference(ref string) bool {
+	return strings.Contains(ref, "://") || strings.HasPrefix(ref, "urn:")
+}
+
+// trimHistory drops the _history suffix of a versioned reference.
+func trimHistory(ref string) string {
+	if i := strings.Index(ref, "/_history/"); i >= 0 {
+		return ref[:i]
+	}
+	return ref
+}
+
+// restfulBase returns the service base of a RESTful fullUrl including the trailing slash, e.g.
+// "http://example.org/fhir/" for "http://example.org/fhir/Patient/1".
+func restfulBase(fullURL string) (string, bool) {
+	if !strings.Contains(fullURL, "://") {
+		return "", false
+	}
+	typeID, ok := referenceTypeID(fullURL)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimRight(trimHistory(fullURL), "/"), typeID), true
+}
+
+// referenceTypeID reduces a relative or absolute RESTful reference to "type/id",
+// dropping any base URL and _history suffix.
+func referenceTypeID(ref string) (string, bool) {
+	ref = trimHistory(ref)
+	segs := strings.Split(strings.TrimRight(ref, "/"), "/")
+	if len(segs) < 2 {
+		return "", false
+	}
+	typ, id := segs[len(segs)-2], segs[len(segs)-1]
+	if typ == "" || id == "" || typ[0] < 'A' || typ[0] > 'Z' {
+		return "", false
+	}
+	return typ + "/" + id, true
+}
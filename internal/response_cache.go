@@ -0,0 +1,468 @@
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCacheConfig configures caching of operation responses.
+type ResponseCacheConfig struct {
+	// Size is the number of responses kept in memory, 0 disables the cache.
+	Size int `json:"size"`
+	// MaxBytes bounds the total size of the responses kept in memory, 0 for no bound.
+	MaxBytes int64 `json:"maxBytes"`
+	// TTL is how long a response is served from the cache.
+	TTL Duration `json:"ttl"`
+	// Dir optionally keeps the responses on disk as well, so they survive restarts. Responses echo
+	// the submitted resources, which may hold patient data, and are written unencrypted (readable
+	// by the owner only), so this is off unless set.
+	Dir string `json:"dir,omitempty"`
+	// DiskSize is the number of responses kept in Dir.
+	DiskSize int `json:"diskSize"`
+}
+
+// Enabled reports whether responses are cached.
+func (c ResponseCacheConfig) Enabled() bool {
+	return c.Size > 0
+}
+
+func (c ResponseCacheConfig) validate() []error {
+	var errs []error
+	if c.Size < 0 {
+		errs = append(errs, errors.New("responseCache.size must not be negative"))
+	}
+	if c.MaxBytes < 0 {
+		errs = append(errs, errors.New("responseCache.maxBytes must not be negative"))
+	}
+	if c.Enabled() && c.TTL <= 0 {
+		errs = append(errs, errors.New("responseCache.ttl must be positive"))
+	}
+	if c.DiskSize < 0 {
+		errs = append(errs, errors.New("responseCache.diskSize must not be negative"))
+	}
+	if c.Dir != "" {
+		if fi, err := os.Stat(c.Dir); err == nil && !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("responseCache.dir %q is not a directory", c.Dir))
+		}
+	}
+	return errs
+}
+
+// ResponseCache is a concurrency-safe, size-bounded LRU cache of operation responses, keyed by a
+// hash of the operation, the response format and the canonicalized request body (expression,
+// context, variables and resource).
+//
+// Lab users often re-submit identical requests. Responses carry an ETag identifying their content.
+// Requests with traces are not cached, as users expect their trace output to reflect a fresh
+// evaluation, nor are expressions whose result depends on the time of evaluation.
+type ResponseCache struct {
+	config ResponseCacheConfig
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   *list.List
+	items     map[string]*list.Element
+	bytes     int64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	// diskMu serializes pruning the cache directory.
+	diskMu    sync.Mutex
+	lastPrune time.Time
+}
+
+// cachedResponse is a cached response, as kept in memory and written to disk.
+type cachedResponse struct {
+	key         string
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+	// Release, Expression and Results are reported in the logs and metrics of cache hits.
+	Release    string    `json:"release,omitempty"`
+	Expression string    `json:"expression,omitempty"`
+	Results    int       `json:"results"`
+	Body       []byte    `json:"body"`
+	Expires    time.Time `json:"expires"`
+}
+
+// ResponseCacheStats is a snapshot of the cache counters.
+type ResponseCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Len       int
+	Bytes     int64
+}
+
+// NewResponseCache returns a cache as configured, creating its directory if needed.
+// A disabled configuration returns a nil cache, which passes every request on.
+func NewResponseCache(config ResponseCacheConfig) (*ResponseCache, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+			return nil, fmt.Errorf("response cache: %w", err)
+		}
+	}
+	return &ResponseCache{config: config, now: time.Now, entries: list.New(), items: make(map[string]*list.Element)}, nil
+}
+
+// Cache serves repeated operation requests from the cache and caches successful responses of next.
+// Requests with "Cache-Control: no-cache" are evaluated again, those with "no-store" bypass the cache.
+func (c *ResponseCache) Cache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c == nil || !isEvaluation(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			if bodyTooLarge(err) {
+				writeOperationOutcome(w, http.StatusRequestEntityTooLarge, "too-costly", err.Error())
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		directives := cacheControl(r.Header)
+		if uncachedPattern.Match(data) || directives["no-store"] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := responseCacheKey(r, data)
+		if !directives["no-cache"] {
+			if entry, ok := c.get(key); ok {
+				info := requestInfoFrom(r.Context())
+				info.setRelease(entry.Release)
+				info.expression = entry.Expression
+				info.results = entry.Results
+				info.cached = true
+				w.Header().Set("X-Cache", "HIT")
+				// Operations are POST requests, which conditional requests can't turn into
+				// 304 Not Modified (RFC 9110, section 13.1.2)
+				if noneMatchFails(r.Header, entry.ETag) {
+					w.Header().Set("ETag", entry.ETag)
+					writeOperationOutcome(w, http.StatusPreconditionFailed, "conflict", "If-None-Match matches the ETag "+entry.ETag)
+					return
+				}
+				writeCachedResponse(w, entry)
+				return
+			}
+		}
+
+		buf := &responseBuffer{header: w.Header()}
+		next.ServeHTTP(buf, r)
+		w.Header().Set("X-Cache", "MISS")
+		if buf.statusCode() != http.StatusOK {
+			w.WriteHeader(buf.statusCode())
+			w.Write(buf.body.Bytes())
+			return
+		}
+
+		sum := sha256.Sum256(buf.body.Bytes())
+		info := requestInfoFrom(r.Context())
+		entry := &cachedResponse{
+			key:         key,
+			ContentType: w.Header().Get("Content-Type"),
+			ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+			Release:     info.release,
+			Expression:  info.expression,
+			Results:     info.results,
+			Body:        buf.body.Bytes(),
+			Expires:     c.now().Add(time.Duration(c.config.TTL)),
+		}
+		c.put(entry)
+		// The response was evaluated anyway, so a miss is answered in full even if its ETag
+		// matches If-None-Match
+		writeCachedResponse(w, entry)
+	})
+}
+
+// uncachedPattern matches request bodies asking for traces, either by a trace() call in the
+// expression or a debug-trace parameter, or for timings (a timing parameter in JSON or XML), and
+// expressions calling the functions depending on the time of evaluation.
+var uncachedPattern = regexp.MustCompile(`trace\s*\(|debug-trace|"name"\s*:\s*"timing"|<name\s+value="timing"|\b(now|today|timeOfDay)\s*\(`)
+
+// cacheControl returns the directives of the Cache-Control header, lower-cased and without arguments.
+func cacheControl(h http.Header) map[string]bool {
+	directives := map[string]bool{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(d, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	return directives
+}
+
+// responseCacheKey hashes the operation, the requested response format and the request body.
+// JSON bodies are canonicalized first, so whitespace and the order of object members don't matter.
+func responseCacheKey(r *http.Request, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{
+		operationName(r),
+		r.URL.Query().Get("_format"),
+		r.Header.Get("Accept"),
+		requestFHIRVersion(r.Context()),
+	} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(canonicalJSON(body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalJSON re-encodes a JSON document with sorted object members and without insignificant
+// whitespace. Anything else, e.g. XML, is returned unchanged.
+func canonicalJSON(data []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return data
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return data
+	}
+	return canonical
+}
+
+// writeCachedResponse writes entry with its ETag.
+func writeCachedResponse(w http.ResponseWriter, entry *cachedResponse) {
+	w.Header().Set("ETag", entry.ETag)
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.Body)
+}
+
+// noneMatchFails reports whether the If-None-Match header of h is "*" or lists etag. Entity tags
+// compare weakly, as responses compressed on the way out carry a weak ETag.
+func noneMatchFails(h http.Header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range h.Values("If-None-Match") {
+		for _, tag := range strings.Split(v, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// get returns the unexpired response for key, from memory or else from disk.
+func (c *ResponseCache) get(key string) (*cachedResponse, bool) {
+	now := c.now()
+	c.mu.Lock()
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*cachedResponse)
+		if now.Before(entry.Expires) {
+			c.entries.MoveToFront(e)
+			c.hits++
+			c.mu.Unlock()
+			return entry, true
+		}
+		c.remove(e)
+	}
+	c.mu.Unlock()
+
+	entry, ok := c.load(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok || !now.Before(entry.Expires) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.add(entry)
+	return entry, true
+}
+
+// put caches entry in memory and on disk.
+func (c *ResponseCache) put(entry *cachedResponse) {
+	c.mu.Lock()
+	c.add(entry)
+	c.mu.Unlock()
+	c.store(entry)
+}
+
+// add inserts entry, evicting the least recently used responses over the bounds. c.mu must be held.
+func (c *ResponseCache) add(entry *cachedResponse) {
+	if c.config.MaxBytes > 0 && int64(len(entry.Body)) > c.config.MaxBytes {
+		return
+	}
+	if e, ok := c.items[entry.key]; ok {
+		c.remove(e)
+	}
+	c.items[entry.key] = c.entries.PushFront(entry)
+	c.bytes += int64(len(entry.Body))
+	for c.entries.Len() > c.config.Size || (c.config.MaxBytes > 0 && c.bytes > c.config.MaxBytes) {
+		c.remove(c.entries.Back())
+		c.evictions++
+	}
+}
+
+// remove drops an element. c.mu must be held.
+func (c *ResponseCache) remove(e *list.Element) {
+	entry := c.entries.Remove(e).(*cachedResponse)
+	delete(c.items, entry.key)
+	c.bytes -= int64(len(entry.Body))
+}
+
+// load reads the response for key from the cache directory, if configured.
+func (c *ResponseCache) load(key string) (*cachedResponse, bool) {
+	if c.config.Dir == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	entry.key = key
+	return &entry, true
+}
+
+// store writes entry to the cache directory, if configured. Failures only cost a later miss.
+func (c *ResponseCache) store(entry *cachedResponse) {
+	if c.config.Dir == "" || c.config.DiskSize <= 0 {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// Write to a temporary file first, so concurrent reads never see a partial response
+	tmp, err := os.CreateTemp(c.config.Dir, entry.key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// The modification time is the expiry, for pruning without reading every file
+		err = os.Chtimes(tmp.Name(), entry.Expires, entry.Expires)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(entry.key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	c.prune()
+}
+
+// prune removes expired responses from the cache directory and the oldest ones beyond DiskSize,
+// at most once per sweepInterval.
+func (c *ResponseCache) prune() {
+	c.diskMu.Lock()
+	defer c.diskMu.Unlock()
+	now := c.now()
+	if now.Sub(c.lastPrune) < sweepInterval {
+		return
+	}
+	c.lastPrune = now
+
+	dirEntries, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		path    string
+		expires time.Time
+	}
+	var files []file
+	for _, de := range dirEntries {
+		info, err := de.Info()
+		if err != nil || !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(c.config.Dir, de.Name())
+		if !now.Before(info.ModTime()) {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, file{path: path, expires: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].expires.After(files[j].expires) })
+	for _, f := range files[min(len(files), c.config.DiskSize):] {
+		os.Remove(f.path)
+	}
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.config.Dir, key+".json")
+}
+
+// Stats returns the current hit, miss and eviction counts and the size of the cached responses.
+func (c *ResponseCache) Stats() ResponseCacheStats {
+	if c == nil {
+		return ResponseCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ResponseCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       c.entries.Len(),
+		Bytes:     c.bytes,
+	}
+}
+
+// responseBuffer holds back a response until it has been cached.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
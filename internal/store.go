@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ResourceStore is a read-only set of resources loaded from disk, used as a local stand-in
+// for a FHIR server when resolving references.
+//
+// Resources are kept as raw JSON and decoded lazily for the release of the requesting endpoint.
+type ResourceStore struct {
+	byTypeID map[string]json.RawMessage
+	// byURL indexes Bundle entries by fullUrl.
+	byURL map[string]json.RawMessage
+	// canonicals holds all versions of canonical resources by their url.
+	canonicals map[string][]canonicalResource
+
+	mu sync.Mutex
+	// decoded holds the resources decoded so far by release and key.
+	decoded map[string]*decodedResource
+}
+
+// decodedResource is a stored resource decoded once for a release. Concurrent requests for the
+// same resource wait for the first decode; others proceed without contention.
+type decodedResource struct {
+	once sync.Once
+	res  model.Resource
+	err  error
+}
+
+// canonicalResource is one version of a canonical resource.
+type canonicalResource struct {
+	version string
+	data    json.RawMessage
+}
+
+// storeEntry captures the fields needed to index a resource without decoding it for a specific release.
+type storeEntry struct {
+	ResourceType string `json:"resourceType"`
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	Version      string `json:"version"`
+	Entry        []struct {
+		FullURL  string          `json:"fullUrl"`
+		Resource json.RawMessage `json:"resource"`
+	} `json:"entry"`
+}
+
+// LoadResourceStore reads all *.json files below dir. Bundles are indexed by their entries
+// in addition to the Bundle itself. Resources sharing a type and id, a fullUrl or a canonical
+// url and version are rejected, as references to them would be ambiguous.
+func LoadResourceStore(dir string) (*ResourceStore, error) {
+	s := &ResourceStore{
+		byTypeID:   make(map[string]json.RawMessage),
+		byURL:      make(map[string]json.RawMessage),
+		canonicals: make(map[string][]canonicalResource),
+		decoded:    make(map[string]*decodedResource),
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".json") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := s.add(data, ""); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load resource store: %w", err)
+	}
+	return s, nil
+}
+
+// Len returns the number of resources indexed by type and id.
+func (s *ResourceStore) Len() int {
+	return len(s.byTypeID)
+}
+
+func (s *ResourceStore) add(data json.RawMessage, fullURL string) error {
+	var e storeEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	if e.ResourceType == "" {
+		return fmt.Errorf("missing resourceType")
+	}
+
+	if e.ID != "" {
+		typeID := e.ResourceType + "/" + e.ID
+		if _, ok := s.byTypeID[typeID]; ok {
+			return fmt.Errorf("duplicate %s", typeID)
+		}
+		s.byTypeID[typeID] = data
+	}
+	if fullURL != "" {
+		if _, ok := s.byURL[fullURL]; ok {
+			return fmt.Errorf("duplicate fullUrl %s", fullURL)
+		}
+		s.byURL[fullURL] = data
+	}
+	if e.URL != "" {
+		for _, c := range s.canonicals[e.URL] {
+			if c.version == e.Version {
+				return fmt.Errorf("duplicate %s version %q", e.URL, e.Version)
+			}
+		}
+		s.canonicals[e.URL] = append(s.canonicals[e.URL], canonicalResource{version: e.Version, data: data})
+	}
+
+	if e.ResourceType == "Bundle" {
+		for _, entry := range e.Entry {
+			if len(entry.Resource) == 0 {
+				continue
+			}
+			if err := s.add(entry.Resource, entry.FullURL); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookup finds the raw JSON for a reference, canonical URL or fullUrl. Canonical URLs without a
+// version resolve to the highest version stored, versioned ones to exactly that version; relative
+// references also resolve by type and id.
+func (s *ResourceStore) lookup(ref string) (string, json.RawMessage, error) {
+	if data, ok := s.byURL[ref]; ok {
+		return ref, data, nil
+	}
+	canonical, version, versioned := strings.Cut(ref, "|")
+	if versions, ok := s.canonicals[canonical]; ok {
+		if versioned {
+			for _, c := range versions {
+				if c.version == version {
+					return ref, c.data, nil
+				}
+			}
+			return "", nil, fmt.Errorf("version %s of %s is not in the store", version, canonical)
+		}
+		highest := versions[0]
+		for _, c := range versions[1:] {
+			if compareVersions(c.version, highest.version) > 0 {
+				highest = c
+			}
+		}
+		return canonical + "|" + highest.version, highest.data, nil
+	}
+	// Absolute URLs name a resource on their server, only relative references are matched by type and id
+	if absoluteReference(ref) {
+		return "", nil, errUnresolved
+	}
+	if typeID, ok := referenceTypeID(ref); ok {
+		if data, ok := s.byTypeID[typeID]; ok {
+			return typeID, data, nil
+		}
+	}
+	return "", nil, errUnresolved
+}
+
+// compareVersions orders business versions by their dot-separated segments, numerically where
+// both segments are numbers, e.g. 1.10 after 1.9.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		if aErr == nil && bErr == nil {
+			if c := cmp.Compare(an, bn); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
+
+// resolveFromStore looks up a reference in the store and decodes the resource for release R.
+// Decoded resources, and decoding errors, are cached per release. References not in the store return errUnresolved.
+func resolveFromStore[R model.Release](s *ResourceStore, ref string) (model.Resource, error) {
+	if s == nil {
+		return nil, errUnresolved
+	}
+	key, data, err := s.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := model.ReleaseName[R]() + " " + key
+	s.mu.Lock()
+	d, ok := s.decoded[cacheKey]
+	if !ok {
+		d = &decodedResource{}
+		s.decoded[cacheKey] = d
+	}
+	s.mu.Unlock()
+
+	d.once.Do(func() {
+		d.res, d.err = decodeResourceFromJSON[R](string(data))
+		if d.err != nil {
+			d.err = fmt.Errorf("stored %s can not be decoded as %s: %w", key, model.ReleaseName[R](), d.err)
+		}
+	})
+	return d.res, d.err
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"strings"
+)
+
+// typeExtensionURL marks result parts with the qualified FHIRPath type of their value, which tells
+// System-typed values (e.g. System.Quantity for a computed quantity) from elements of the resource
+// (e.g. FHIR.Quantity).
+const typeExtensionURL = "http://fhir.forms-lab.com/StructureDefinition/fhirpath-type"
+
+// qualifiedTypeName returns the namespace-qualified type name of e, e.g. "System.Integer" or "FHIR.HumanName".
+func qualifiedTypeName(e fhirpath.Element) string {
+	if ti := e.TypeInfo(); ti != nil {
+		if q, ok := ti.QualifiedName(); ok && q.Name != "" {
+			if q.Namespace == "" {
+				return q.Name
+			}
+			return q.Namespace + "." + q.Name
+		}
+	}
+	return "Element"
+}
+
+// systemValue is a System-typed result in terms of the FHIR data type it is emitted as.
+type systemValue struct {
+	// fhirType is the FHIR type the value maps to, or "string" if its lexical form isn't valid for it
+	// (a Time without seconds). DateTimes keep their type at any precision, with or without time zone.
+	fhirType string
+	// lexical is the exact lexical form, at the precision of the value.
+	lexical string
+	boolean bool
+	integer int32
+	long    int64
+	// decimal holds Decimal and Quantity values, and Long values for releases without integer64.
+	decimal fhirpath.Decimal
+	// unit is the quantity unit, ucum reports whether it is a UCUM code rather than a calendar duration.
+	unit string
+	ucum bool
+}
+
+// calendarUnits are the FHIRPath calendar duration keywords, which are not UCUM units.
+var calendarUnits = map[string]bool{
+	"year": true, "years": true, "month": true, "months": true, "week": true, "weeks": true,
+	"day": true, "days": true, "hour": true, "hours": true, "minute": true, "minutes": true,
+	"second": true, "seconds": true, "millisecond": true, "milliseconds": true,
+}
+
+// systemValueOf describes a System-typed value, returning false for model (FHIR) elements.
+func systemValueOf(e fhirpath.Element) (systemValue, bool) {
+	switch v := e.(type) {
+	case fhirpath.Boolean:
+		return systemValue{fhirType: "boolean", lexical: v.String(), boolean: bool(v)}, true
+	case fhirpath.String:
+		return systemValue{fhirType: "string", lexical: string(v)}, true
+	case fhirpath.Integer:
+		return systemValue{fhirType: "integer", lexical: v.String(), integer: int32(v)}, true
+	case fhirpath.Long:
+		d, _, err := v.ToDecimal(false)
+		if err != nil {
+			return systemValue{}, false
+		}
+		return systemValue{fhirType: "integer64", lexical: strings.TrimSuffix(v.String(), "L"), long: int64(v), decimal: d}, true
+	case fhirpath.Decimal:
+		if v.Value == nil {
+			return systemValue{}, false
+		}
+		return systemValue{fhirType: "decimal", lexical: v.String(), decimal: v}, true
+	case fhirpath.Date:
+		return systemValue{fhirType: "date", lexical: v.String()}, true
+	case fhirpath.DateTime:
+		return systemValue{fhirType: "dateTime", lexical: v.String()}, true
+	case fhirpath.Time:
+		sv := systemValue{fhirType: "time", lexical: strings.TrimPrefix(v.String(), "@T")}
+		if v.Precision != fhirpath.TimePrecisionSecond && v.Precision != fhirpath.TimePrecisionMillisecond {
+			sv.fhirType = "string"
+		}
+		return sv, true
+	case fhirpath.Quantity:
+		if v.Value.Value == nil {
+			return systemValue{}, false
+		}
+		unit := strings.Trim(strings.TrimSpace(string(v.Unit)), "'")
+		return systemValue{
+			fhirType: "Quantity",
+			lexical:  v.String(),
+			decimal:  v.Value,
+			unit:     unit,
+			ucum:     unit != "" && !calendarUnits[unit],
+		}, true
+	}
+	return systemValue{}, false
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// phaseTimings is the time spent parsing and evaluating, reported in the timing part of responses
+// if requested. Evaluating the expression is timed per context item, see resultEntry.
+type phaseTimings struct {
+	parseExpression time.Duration
+	parseContext    time.Duration
+	evaluateContext time.Duration
+}
+
+type requestDecodingKey struct{}
+
+// requestDecoding is the time spent decoding the request body into Parameters, either by
+// ReleaseParameters or by the framework it passed the body on to.
+type requestDecoding struct {
+	decoded time.Duration
+	// passedOn is when the body was passed on to the framework, which decodes it before invoking
+	// the backend. Zero once the duration is known.
+	passedOn time.Time
+}
+
+// withRequestDecoding records that decoding the request body took d.
+func withRequestDecoding(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, requestDecodingKey{}, &requestDecoding{decoded: d})
+}
+
+// withFrameworkDecoding records that the framework decodes the request body from now on.
+func withFrameworkDecoding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestDecodingKey{}, &requestDecoding{passedOn: time.Now()})
+}
+
+// requestDecodingTime returns the time spent decoding the request body, 0 if not recorded. For
+// bodies decoded by the framework, the first call of the invoked operation stops the clock.
+func requestDecodingTime(ctx context.Context) time.Duration {
+	d, ok := ctx.Value(requestDecodingKey{}).(*requestDecoding)
+	if !ok {
+		return 0
+	}
+	if !d.passedOn.IsZero() {
+		d.decoded, d.passedOn = time.Since(d.passedOn), time.Time{}
+	}
+	return d.decoded
+}
+
+// microseconds converts d to a decimal D (e.g. r4.Decimal) of microseconds with nanosecond
+// precision, e.g. 12.345.
+func microseconds[D any, P interface {
+	*D
+	UnmarshalJSON([]byte) error
+}](d time.Duration) D {
+	var v D
+	ns := d.Nanoseconds()
+	P(&v).UnmarshalJSON(fmt.Appendf(nil, "%d.%03d", ns/1000, ns%1000))
+	return v
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig enables serving HTTPS, optionally verifying client certificates (mutual TLS).
+type TLSConfig struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// ClientCA is a PEM bundle of CAs client certificates are verified against.
+	ClientCA string `json:"clientCA,omitempty"`
+	// ClientAuth is "require" (the default when ClientCA is set), "optional" (verify certificates
+	// presented) or "none".
+	ClientAuth string `json:"clientAuth,omitempty"`
+}
+
+// Enabled reports whether a certificate is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+func (c TLSConfig) validate() []error {
+	var errs []error
+	if (c.Cert == "") != (c.Key == "") {
+		errs = append(errs, errors.New("tls.cert and tls.key must be set together"))
+	}
+	if c.ClientCA != "" && !c.Enabled() {
+		errs = append(errs, errors.New("tls.clientCA requires tls.cert and tls.key"))
+	}
+	switch c.ClientAuth {
+	case "", "none":
+	case "optional", "require":
+		if c.ClientCA == "" {
+			errs = append(errs, fmt.Errorf("tls.clientAuth %q requires tls.clientCA", c.ClientAuth))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tls.clientAuth must be none, optional or require, got %q", c.ClientAuth))
+	}
+	// Load the files once, so unreadable or mismatched certificates fail at startup
+	if len(errs) == 0 && c.Enabled() {
+		if _, err := NewTLSConfig(c); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+	return errs
+}
+
+// certCheckInterval throttles checking the certificate files for changes.
+var certCheckInterval = time.Second
+
+// NewTLSConfig builds the server TLS configuration. The certificate is reloaded on the next
+// handshake after its files changed, so renewed certificates are picked up without a restart.
+// ALPN protocols are left to http.Server, which offers h2 according to its Protocols.
+func NewTLSConfig(c TLSConfig) (*tls.Config, error) {
+	reloader := &certReloader{certFile: c.Cert, keyFile: c.Key}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", c.ClientCA)
+		}
+		config.ClientCAs = pool
+		switch c.ClientAuth {
+		case "none":
+			config.ClientAuth = tls.NoClientCert
+		case "optional":
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// certReloader serves a certificate key pair, reloading it when either file's modification time changes.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) >= certCheckInterval {
+		r.lastCheck = time.Now()
+		if r.changed() {
+			// Keep serving the previous certificate if the new files are incomplete or invalid
+			if err := r.loadLocked(); err != nil {
+				slog.Warn("reloading TLS certificate failed", "cert", r.certFile, "error", err)
+			} else {
+				slog.Info("reloaded TLS certificate", "cert", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+func (r *certReloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *certReloader) loadLocked() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certModTime, r.keyModTime = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	fhirpath "github.com/damedic/fhir-toolbox-go/fhirpath"
+	"github.com/damedic/fhir-toolbox-go/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TracingConfig configures the export of OpenTelemetry traces.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces.
+	// Tracing is disabled without one.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export, e.g. for authentication at the collector.
+	Headers map[string]Secret `json:"headers,omitempty"`
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string `json:"serviceName"`
+	// SampleRatio is the fraction of requests traced, unless the caller decided by a traceparent header.
+	SampleRatio float64 `json:"sampleRatio"`
+	// ExportInterval is how often finished spans are exported.
+	ExportInterval Duration `json:"exportInterval"`
+}
+
+// Enabled reports whether traces are exported.
+func (c TracingConfig) Enabled() bool {
+	return c.Endpoint != ""
+}
+
+func (c TracingConfig) validate() []error {
+	var errs []error
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint %q must be an http(s) URL", c.Endpoint))
+		}
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		errs = append(errs, errors.New("tracing.sampleRatio must be between 0 and 1"))
+	}
+	if c.Enabled() && c.ExportInterval <= 0 {
+		errs = append(errs, errors.New("tracing.exportInterval must be positive"))
+	}
+	return errs
+}
+
+const (
+	// maxQueuedSpans bounds the spans waiting for export, further ones are dropped.
+	maxQueuedSpans = 4096
+	// maxExportBatch is the number of spans from which an export starts before the interval elapsed.
+	maxExportBatch = 512
+	// instrumentationName is the instrumentation scope of the spans.
+	instrumentationName = "fhirpath-lab-go"
+)
+
+// Tracer records spans of requests with OpenTelemetry and exports them in batches via OTLP/HTTP.
+//
+// The server span of a request continues the trace of a W3C traceparent header, so the
+// evaluation shows up in the caller's trace. Without an endpoint, spans go to a no-op provider.
+type Tracer struct {
+	provider trace.TracerProvider
+	shutdown func(context.Context) error
+}
+
+// NewTracer starts exporting spans as configured. Export failures are logged, tracing must not
+// hold up or fail evaluations.
+func NewTracer(config TracingConfig, logger *slog.Logger) (*Tracer, error) {
+	if !config.Enabled() {
+		return &Tracer{provider: noop.NewTracerProvider(), shutdown: func(context.Context) error { return nil }}, nil
+	}
+
+	headers := make(map[string]string, len(config.Headers))
+	for name, value := range config.Headers {
+		headers[name] = string(value)
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.Endpoint),
+		otlptracehttp.WithHeaders(headers),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("exporting spans failed", "error", err)
+	}))
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithBatchTimeout(time.Duration(config.ExportInterval)),
+			sdktrace.WithMaxQueueSize(maxQueuedSpans),
+			sdktrace.WithMaxExportBatchSize(maxExportBatch),
+		),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.ServiceName),
+			attribute.String("service.version", ReadBuildInfo().SoftwareVersion()),
+		)),
+	)
+	return &Tracer{provider: provider, shutdown: provider.Shutdown}, nil
+}
+
+// Trace records a server span for every request handled by next.
+func (t *Tracer) Trace(next http.Handler) http.Handler {
+	tracer := t.provider.Tracer(instrumentationName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+operationName(r),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("fhirpath.operation", operationName(r)),
+			),
+		)
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.statusCode()))
+		if rec.statusCode() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.statusCode()))
+		}
+	})
+}
+
+// Shutdown exports the remaining spans, waiting until ctx is done at most. Later calls do nothing.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.shutdown(ctx)
+}
+
+// startSpan starts a child of the span in ctx. Requests that are not traced get non-recording spans.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName).Start(ctx, name)
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// parseParametersTraced runs parseParameters in a span of the request trace.
+func parseParametersTraced[R model.Release](ctx context.Context, parameters fhirpath.Element) (inputs evalInputs, err error) {
+	decoding := requestDecodingTime(ctx)
+	_, span := startSpan(ctx, "parseParameters")
+	defer func() { endSpan(span, err) }()
+	span.SetAttributes(attribute.String("fhirpath.release", model.ReleaseName[R]()))
+	inputs, err = parseParameters[R](parameters)
+	if err != nil {
+		return inputs, err
+	}
+	inputs.decodeResource += decoding
+	span.SetAttributes(attribute.Int("fhirpath.expression.length", len(inputs.expression)))
+	return inputs, nil
+}
+
+// buildTraced runs build, serializing result with one of the build*Parameters functions, in a
+// span of the request trace.
+func buildTraced[P any](ctx context.Context, name string, result evalResult, build func() P) P {
+	_, span := startSpan(ctx, name)
+	defer span.End()
+	span.SetAttributes(attribute.Int("fhirpath.result.count", resultCount(result)))
+	return build()
+}
+
+// resultCount is the number of result values over all context items.
+func resultCount(result evalResult) int {
+	n := 0
+	for _, r := range result.results {
+		n += len(r.values)
+	}
+	return n
+}
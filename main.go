@@ -1,74 +1,152 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fhirpath-lab-go/internal"
 	"flag"
+	"fmt"
 	"github.com/damedic/fhir-toolbox-go/model"
 	"github.com/damedic/fhir-toolbox-go/rest"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	var addrFlag string
-	flag.StringVar(&addrFlag, "addr", "", "listen address, e.g. :3001 or 127.0.0.1:3001 (overrides PORT)")
-	flag.Parse()
-
-	addr := ":3001"
-	if strings.TrimSpace(addrFlag) != "" {
-		addr = addrFlag
-	} else if v := os.Getenv("PORT"); strings.TrimSpace(v) != "" {
-		if strings.HasPrefix(v, ":") || strings.Contains(v, ":") {
-			addr = v
-		} else {
-			addr = ":" + v
+	config, err := internal.LoadConfig(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if config.Mode == internal.ModePrintConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		return
 	}
 
-	backend := &internal.Backend{BaseURL: addr}
-	server := withCORS(&rest.Server[model.R4]{Backend: backend})
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	slog.SetDefault(logger)
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "error", err)
+		os.Exit(1)
+	}
 
-	log.Printf("fhirpath-lab-go-cmd listening on %s", addr)
-	if err := http.ListenAndServe(addr, server); err != nil {
-		log.Fatal(err)
+	addr := config.Addr
+	backend := &internal.Backend{BaseURL: addr, ParseCache: internal.NewParseCache(config.ParseCache, config.ParseCacheBytes), EchoResource: config.EchoResource}
+	if config.Store != "" {
+		store, err := internal.LoadResourceStore(config.Store)
+		if err != nil {
+			fatal("loading the resource store failed", err)
+		}
+		logger.Info("loaded resource store", "resources", store.Len(), "dir", config.Store)
+		backend.Store = store
 	}
-}
+	authenticators, err := internal.NewAuthenticators(config.Auth)
+	if err != nil {
+		fatal("configuring authentication failed", err)
+	}
+	responseCache, err := internal.NewResponseCache(config.ResponseCache)
+	if err != nil {
+		fatal("opening the response cache failed", err)
+	}
+	metrics := internal.NewMetrics()
+	metrics.ParseCache = backend.ParseCache
+	metrics.ResponseCache = responseCache
+
+	var server http.Handler = &rest.Server[model.R4]{Backend: backend}
+	server = internal.ReleaseParameters(server)
+	server = responseCache.Cache(server)
+	server = internal.NegotiateFormat(server)
+	server = metrics.CountInFlight(server)
+	// Clients are limited by address before authenticating, so credentials can't be guessed at
+	// full speed, and by principal once authenticated
+	throttler := internal.NewThrottler(config.Throttle)
+	server = throttler.Principals(server)
+	authenticate := internal.Authenticate(authenticators...)
+	server = throttler.Addresses(authenticate(server))
+	server = metrics.Instrument(server)
 
-// CORS helpers
-func corsAllowedOrigin(origin string) (string, bool) {
-	allowed := []string{
-		"https://fhirpath-lab.com",
-		"https://dev.fhirpath-lab.com",
-		"https://hackweek.fhirpath-lab.com",
-		"http://localhost:3000",
+	// Only the liveness probe stays open when authentication is configured
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", authenticate(metrics.Handler()))
+	mux.Handle("GET /healthz", internal.HealthHandler())
+	mux.Handle("GET /readyz", authenticate(internal.ReadinessHandler()))
+	mux.Handle("GET /version", authenticate(internal.VersionHandler()))
+	mux.Handle("/", server)
+
+	handler := internal.MaxBodySize(config.Server.MaxBodyBytes)(internal.CORS(config.CORS)(mux))
+	handler = internal.Compress(config.Compression)(handler)
+	handler = internal.RequestLogger(logger, config.Log)(handler)
+	tracer, err := internal.NewTracer(config.Tracing, logger)
+	if err != nil {
+		fatal("configuring tracing failed", err)
+	}
+	handler = tracer.Trace(handler)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(config.Server.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(config.Server.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(config.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(config.Server.IdleTimeout),
+		MaxHeaderBytes:    config.Server.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		Protocols:         new(http.Protocols),
 	}
-	for _, a := range allowed {
-		if strings.EqualFold(origin, a) {
-			return a, true
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(config.Server.HTTP2)
+	if config.TLS.Enabled() {
+		srv.TLSConfig, err = internal.NewTLSConfig(config.TLS)
+		if err != nil {
+			fatal("configuring TLS failed", err)
 		}
 	}
-	return "", false
-}
-func writeCORS(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	if o, ok := corsAllowedOrigin(origin); ok {
-		w.Header().Set("Access-Control-Allow-Origin", o)
-		w.Header().Set("Vary", "Origin")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	if config.Mode == internal.ModeCheckConfig {
+		if err := tracer.Shutdown(context.Background()); err != nil {
+			fatal("stopping tracing failed", err)
+		}
+		logger.Info("configuration is valid")
+		return
 	}
-}
 
-// withCORS wraps a handler to write CORS headers and handle OPTIONS preflight.
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		writeCORS(w, r)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate, so it can be reloaded
+			logger.Info("fhirpath-lab-go-cmd listening", "addr", addr, "tls", true)
+			errs <- srv.ListenAndServeTLS("", "")
 			return
 		}
-		next.ServeHTTP(w, r)
-	})
+		logger.Info("fhirpath-lab-go-cmd listening", "addr", addr, "tls", false)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		fatal("serving failed", err)
+	case <-ctx.Done():
+	}
+
+	// Stop accepting connections and let in-flight evaluations finish
+	stop()
+	logger.Info("shutting down, draining requests", "timeout", config.Server.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Server.ShutdownTimeout))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fatal("shutdown failed", err)
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("exporting the remaining spans failed", "error", err)
+	}
 }